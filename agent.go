@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kovetskiy/lorg"
+	"github.com/reconquest/hierr-go"
+)
+
+const (
+	agentPollInterval     = 5 * time.Second
+	agentUploadInterval   = 2 * time.Second
+	agentMinimalHeartbeat = time.Second
+)
+
+// AgentClient is the agent side of distributed builds, it registers on the
+// uroboros server, leases tasks from its queue, processes them locally and
+// streams logs and results back.
+type AgentClient struct {
+	logger    *lorg.Log
+	resources *resources
+	server    string
+	name      string
+	labels    []string
+	threads   int
+	id        string
+	timeout   time.Duration
+	client    *http.Client
+	mutex     *sync.Mutex
+}
+
+func NewAgentClient(
+	logger *lorg.Log,
+	resources *resources,
+	server string,
+	name string,
+	labels []string,
+) *AgentClient {
+	return &AgentClient{
+		logger:    logger,
+		resources: resources,
+		server:    strings.TrimSuffix(server, "/"),
+		name:      name,
+		labels:    labels,
+		timeout:   defaultLeaseTimeout,
+		client:    &http.Client{Timeout: time.Minute},
+		mutex:     &sync.Mutex{},
+	}
+}
+
+// Run registers agent on the server and serves leased tasks using given
+// amount of threads, never returns unless registration is failed.
+func (agent *AgentClient) Run(threads int) error {
+	agent.threads = threads
+
+	err := agent.register()
+	if err != nil {
+		return err
+	}
+
+	for i := 1; i <= threads; i++ {
+		agent.logger.Infof("[%d/%d] spawning thread", i, threads)
+		go agent.work()
+	}
+
+	agent.heartbeat()
+
+	return nil
+}
+
+func (agent *AgentClient) register() error {
+	var response ResponseAgent
+	status, err := agent.request(
+		"agents/",
+		url.Values{
+			"name":    {agent.name},
+			"labels":  {strings.Join(agent.labels, ",")},
+			"threads": {strconv.Itoa(agent.threads)},
+		},
+		&response,
+	)
+	if err != nil {
+		return hierr.Errorf(
+			err,
+			"can't register agent at %s", agent.server,
+		)
+	}
+
+	if status != http.StatusOK {
+		return fmt.Errorf(
+			"can't register agent at %s: %d %s",
+			agent.server, status, http.StatusText(status),
+		)
+	}
+
+	agent.mutex.Lock()
+	agent.id = response.ID
+	agent.mutex.Unlock()
+
+	agent.setTimeout(response.LeaseTimeout)
+
+	agent.logger.Infof("registered as %s", response.ID)
+
+	return nil
+}
+
+func (agent *AgentClient) getID() string {
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+
+	return agent.id
+}
+
+// setTimeout updates lease timeout which is returned by the server, empty
+// timeout is returned by servers which don't report it.
+func (agent *AgentClient) setTimeout(value string) {
+	if value == "" {
+		return
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		agent.logger.Error(
+			hierr.Errorf(err, "can't parse lease timeout of the server"),
+		)
+		return
+	}
+
+	agent.mutex.Lock()
+	agent.timeout = timeout
+	agent.mutex.Unlock()
+}
+
+// getHeartbeatInterval returns interval of heartbeats which is a fraction of
+// lease timeout of the server, so a few heartbeats can be lost without
+// losing leases.
+func (agent *AgentClient) getHeartbeatInterval() time.Duration {
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+
+	interval := agent.timeout / 4
+	if interval < agentMinimalHeartbeat {
+		interval = agentMinimalHeartbeat
+	}
+
+	return interval
+}
+
+func (agent *AgentClient) heartbeat() {
+	for {
+		time.Sleep(agent.getHeartbeatInterval())
+
+		status, err := agent.request(
+			"agents/"+agent.getID()+"/heartbeat", nil, nil,
+		)
+		if err != nil {
+			agent.logger.Error(hierr.Errorf(err, "can't send heartbeat"))
+			continue
+		}
+
+		if status == http.StatusNotFound {
+			agent.logger.Warningf(
+				"agent %s is expired on the server, registering again",
+				agent.getID(),
+			)
+
+			err = agent.register()
+			if err != nil {
+				agent.logger.Error(err)
+			}
+		}
+	}
+}
+
+func (agent *AgentClient) work() {
+	for {
+		var lease ResponseLease
+		status, err := agent.request(
+			"agents/"+agent.getID()+"/lease", nil, &lease,
+		)
+		if err != nil {
+			agent.logger.Error(hierr.Errorf(err, "can't lease task"))
+		}
+
+		if err != nil || status != http.StatusOK {
+			time.Sleep(agentPollInterval)
+			continue
+		}
+
+		agent.setTimeout(lease.LeaseTimeout)
+
+		agent.serve(agent.getID(), lease)
+	}
+}
+
+func (agent *AgentClient) serve(id string, lease ResponseLease) {
+	agent.logger.Infof("serving task#%d %s", lease.ID, lease.URL)
+
+	task, err := restoreTask(lease.Kind, lease.URL)
+	if err != nil {
+		agent.logger.Error(err)
+		agent.report(id, lease.ID, url.Values{
+			"state": {TaskStateError.String()},
+		})
+		return
+	}
+
+	priority, _ := ParseTaskPriority(lease.Priority)
+
+	task.SetUniqueID(lease.ID)
+	task.SetPriority(priority)
+	task.SetLabels(lease.Labels)
+	task.SetApproved(lease.Approved)
+	task.SetCommit(lease.Commit)
+
+	var (
+		done     = make(chan struct{})
+		uploaded = make(chan struct{})
+	)
+
+	go func() {
+		agent.upload(id, task, done)
+		close(uploaded)
+	}()
+
+	processor := NewProcessor(task)
+	processor.SetResources(agent.resources)
+	processor.SetLogger(
+		getTaskLogger(
+			agent.logger, task,
+			newSecretMasker(agent.resources.getSecrets(task)),
+		),
+	)
+	processor.Process()
+
+	close(done)
+	<-uploaded
+
+	agent.finish(id, task)
+}
+
+// upload periodically sends new contents of task buffers to the server until
+// done is closed, the last portion is sent after that. The task is cancelled
+// if it's cancelled on the server.
+func (agent *AgentClient) upload(id string, task Task, done chan struct{}) {
+	var logsOffset, errorsOffset int
+
+	for {
+		var finished bool
+		select {
+		case <-done:
+			finished = true
+		case <-time.After(agentUploadInterval):
+		}
+
+		var (
+			logs   = task.GetBuffer().Bytes()
+			errors = task.GetErrorBuffer().Bytes()
+		)
+
+		// logs are sent even if there is nothing new, so the agent finds
+		// out that the task is cancelled on the server.
+		if !finished || len(logs) > logsOffset || len(errors) > errorsOffset {
+			status, err := agent.request(
+				fmt.Sprintf("agents/%s/tasks/%d/logs", id, task.GetUniqueID()),
+				url.Values{
+					"logs":   {string(logs[logsOffset:])},
+					"errors": {string(errors[errorsOffset:])},
+				},
+				nil,
+			)
+			if err != nil {
+				agent.logger.Error(hierr.Errorf(err, "can't upload logs"))
+			} else {
+				logsOffset = len(logs)
+				errorsOffset = len(errors)
+			}
+
+			if status == http.StatusGone && task.GetContext().Err() == nil {
+				agent.logger.Warningf(
+					"task#%d is cancelled on the server", task.GetUniqueID(),
+				)
+
+				task.Cancel()
+			}
+		}
+
+		if finished {
+			return
+		}
+	}
+}
+
+// finish sends state and structured results of the task to the server.
+func (agent *AgentClient) finish(id string, task Task) {
+	findings, err := json.Marshal(task.GetLintFindings())
+	if err != nil {
+		agent.logger.Error(err)
+	}
+
+	tests, err := json.Marshal(task.GetTestReport())
+	if err != nil {
+		agent.logger.Error(err)
+	}
+
+	coverage, err := json.Marshal(task.GetCoverage())
+	if err != nil {
+		agent.logger.Error(err)
+	}
+
+	usage, err := json.Marshal(task.GetResourceUsage())
+	if err != nil {
+		agent.logger.Error(err)
+	}
+
+	environment, err := json.Marshal(task.GetEnvironment())
+	if err != nil {
+		agent.logger.Error(err)
+	}
+
+	agent.report(id, task.GetUniqueID(), url.Values{
+		"state":         {task.GetState().String()},
+		"lint_findings": {string(findings)},
+		"test_report":   {string(tests)},
+		"coverage":      {string(coverage)},
+		"usage":         {string(usage)},
+		"environment":   {string(environment)},
+		"commit":        {task.GetCommit()},
+	})
+}
+
+func (agent *AgentClient) report(id string, taskID int64, values url.Values) {
+	status, err := agent.request(
+		fmt.Sprintf("agents/%s/tasks/%d/finish", id, taskID),
+		values,
+		nil,
+	)
+	if err != nil {
+		agent.logger.Error(
+			hierr.Errorf(err, "can't report result of task#%d", taskID),
+		)
+		return
+	}
+
+	if status != http.StatusOK {
+		agent.logger.Errorf(
+			"can't report result of task#%d: %d %s",
+			taskID, status, http.StatusText(status),
+		)
+	}
+}
+
+func (agent *AgentClient) request(
+	path string,
+	values url.Values,
+	result interface{},
+) (int, error) {
+	request, err := http.NewRequest(
+		"POST",
+		agent.server+pathAPI+path,
+		strings.NewReader(values.Encode()),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set(
+		"Authorization", "Bearer "+agent.resources.config.Agents.Token,
+	)
+
+	response, err := agent.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+
+	defer response.Body.Close()
+
+	if result == nil || response.StatusCode != http.StatusOK {
+		_, err = ioutil.ReadAll(response.Body)
+		return response.StatusCode, err
+	}
+
+	return response.StatusCode, json.NewDecoder(response.Body).Decode(result)
+}
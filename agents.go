@@ -0,0 +1,315 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kovetskiy/lorg"
+)
+
+const defaultLeaseTimeout = time.Minute
+
+// Agent is a remote uroboros process which leases tasks from the queue and
+// processes them on its own host.
+type Agent struct {
+	ID       string
+	Name     string
+	Labels   []string
+	Threads  int
+	LastSeen time.Time
+	Tasks    map[int64]Task
+}
+
+type Agents struct {
+	logger   *lorg.Log
+	queue    *Queue
+	history  *History
+	coverage *CoverageHistory
+	timeout  time.Duration
+	agents   map[string]*Agent
+	sequence int64
+	mutex    *sync.Mutex
+}
+
+func NewAgents(
+	logger *lorg.Log,
+	queue *Queue,
+	history *History,
+	coverage *CoverageHistory,
+	timeout time.Duration,
+) *Agents {
+	return &Agents{
+		logger:   logger,
+		queue:    queue,
+		history:  history,
+		coverage: coverage,
+		timeout:  timeout,
+		agents:   map[string]*Agent{},
+		mutex:    &sync.Mutex{},
+	}
+}
+
+func (agents *Agents) SetTimeout(timeout time.Duration) {
+	agents.mutex.Lock()
+	defer agents.mutex.Unlock()
+
+	agents.timeout = timeout
+}
+
+// GetTimeout returns lease timeout, agents should send heartbeats more often
+// than that.
+func (agents *Agents) GetTimeout() time.Duration {
+	agents.mutex.Lock()
+	defer agents.mutex.Unlock()
+
+	return agents.timeout
+}
+
+func (agents *Agents) Register(
+	name string,
+	labels []string,
+	threads int,
+) *Agent {
+	agents.mutex.Lock()
+	defer agents.mutex.Unlock()
+
+	agent := &Agent{
+		ID: fmt.Sprintf(
+			"agent-%d", atomic.AddInt64(&agents.sequence, 1),
+		),
+		Name:     name,
+		Labels:   labels,
+		Threads:  threads,
+		LastSeen: time.Now(),
+		Tasks:    map[int64]Task{},
+	}
+
+	agents.agents[agent.ID] = agent
+
+	agents.logger.Infof(
+		"registered %s (%s) with %d threads and labels %q",
+		agent.ID, agent.Name, agent.Threads, agent.Labels,
+	)
+
+	return agent
+}
+
+// GetThreads returns total amount of threads of registered agents.
+func (agents *Agents) GetThreads() int {
+	agents.mutex.Lock()
+	defer agents.mutex.Unlock()
+
+	threads := 0
+	for _, agent := range agents.agents {
+		threads += agent.Threads
+	}
+
+	return threads
+}
+
+// Heartbeat prolongs leases of all tasks of the given agent, returns false if
+// the agent is not registered or has already expired.
+func (agents *Agents) Heartbeat(id string) bool {
+	agents.mutex.Lock()
+	defer agents.mutex.Unlock()
+
+	agent, ok := agents.agents[id]
+	if !ok {
+		return false
+	}
+
+	agent.LastSeen = time.Now()
+
+	return true
+}
+
+// Lease takes the first task which is available for the given agent, returns
+// nil if there is no such task.
+func (agents *Agents) Lease(id string) (Task, error) {
+	agents.mutex.Lock()
+	defer agents.mutex.Unlock()
+
+	agent, ok := agents.agents[id]
+	if !ok {
+		return nil, fmt.Errorf("agent %s is not registered", id)
+	}
+
+	agent.LastSeen = time.Now()
+
+	task := agents.queue.TryPop(agent.Labels)
+	if task == nil {
+		return nil, nil
+	}
+
+	agent.Tasks[task.GetUniqueID()] = task
+
+	task.SetState(TaskStateProcessing)
+
+	agents.logger.Infof(
+		"task#%d leased by %s (%s)",
+		task.GetUniqueID(), agent.ID, agent.Name,
+	)
+
+	return task, nil
+}
+
+// GetTask returns task leased by the given agent.
+func (agents *Agents) GetTask(id string, taskID int64) (Task, error) {
+	agents.mutex.Lock()
+	defer agents.mutex.Unlock()
+
+	agent, ok := agents.agents[id]
+	if !ok {
+		return nil, fmt.Errorf("agent %s is not registered", id)
+	}
+
+	agent.LastSeen = time.Now()
+
+	task, ok := agent.Tasks[taskID]
+	if !ok {
+		return nil, fmt.Errorf(
+			"task#%d is not leased by agent %s", taskID, id,
+		)
+	}
+
+	return task, nil
+}
+
+// Finish releases the lease and marks the task finished with given state.
+func (agents *Agents) Finish(id string, taskID int64, state TaskState) error {
+	task, err := agents.GetTask(id, taskID)
+	if err != nil {
+		return err
+	}
+
+	agents.mutex.Lock()
+	delete(agents.agents[id].Tasks, taskID)
+	agents.mutex.Unlock()
+
+	task.SetState(state)
+
+	if state == TaskStateAwaitingApproval {
+		agents.queue.Done(task)
+
+		agents.logger.Infof(
+			"task#%d is awaiting approval, reported by %s", taskID, id,
+		)
+
+		return nil
+	}
+
+	task.SetFinishedAt(time.Now())
+
+	agents.queue.Done(task)
+	agents.history.Add(task)
+	agents.coverage.Add(task)
+
+	agents.logger.Infof(
+		"task#%d finished by %s with state %s", taskID, id, state,
+	)
+
+	return nil
+}
+
+func (agents *Agents) GetAgents() []Agent {
+	agents.mutex.Lock()
+	defer agents.mutex.Unlock()
+
+	list := []Agent{}
+	for _, agent := range agents.agents {
+		copied := *agent
+		copied.Tasks = map[int64]Task{}
+		for id, task := range agent.Tasks {
+			copied.Tasks[id] = task
+		}
+
+		list = append(list, copied)
+	}
+
+	return list
+}
+
+// Watch periodically removes agents which didn't send heartbeats for longer
+// than lease timeout and returns their tasks back to the queue.
+func (agents *Agents) Watch() {
+	for {
+		agents.mutex.Lock()
+		timeout := agents.timeout
+		agents.mutex.Unlock()
+
+		time.Sleep(timeout / 4)
+
+		agents.expire()
+	}
+}
+
+func (agents *Agents) expire() {
+	agents.mutex.Lock()
+	defer agents.mutex.Unlock()
+
+	for id, agent := range agents.agents {
+		if time.Since(agent.LastSeen) < agents.timeout {
+			continue
+		}
+
+		agents.logger.Warningf(
+			"%s (%s) didn't send heartbeat for %s, removing it",
+			agent.ID, agent.Name, time.Since(agent.LastSeen),
+		)
+
+		for _, task := range agent.Tasks {
+			fmt.Fprintf(
+				task.GetBuffer(),
+				"agent %s vanished, task returned to the queue\n",
+				agent.Name,
+			)
+
+			agents.queue.Requeue(task)
+		}
+
+		delete(agents.agents, id)
+	}
+}
+
+const (
+	taskKindStashPullRequest = "stash-pull-request"
+	taskKindStashBranch      = "stash-branch"
+)
+
+// describeTask returns kind and URL of the task which are enough for agent
+// to construct the same task on its side.
+func describeTask(task Task) (string, string) {
+	switch target := task.(type) {
+	case *TaskStashPullRequest:
+		return taskKindStashPullRequest, target.URL
+
+	case *TaskStashBranch:
+		return taskKindStashBranch, target.URL
+	}
+
+	panic("unexpected task")
+}
+
+func restoreTask(kind string, url string) (Task, error) {
+	switch kind {
+	case taskKindStashPullRequest:
+		task, err := NewTaskStashPullRequest(url)
+		if err != nil {
+			return nil, err
+		}
+
+		return task, nil
+
+	case taskKindStashBranch:
+		task, err := NewTaskStashBranch(url)
+		if err != nil {
+			return nil, err
+		}
+
+		return task, nil
+	}
+
+	return nil, fmt.Errorf("unexpected task kind: %s", kind)
+}
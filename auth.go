@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/kovetskiy/ko"
+	"github.com/reconquest/hierr-go"
+)
+
+// Scopes of API tokens, every scope includes previous ones: submit token can
+// read tasks and admin token can do anything.
+const (
+	scopeRead   = "read"
+	scopeSubmit = "submit"
+	scopeAdmin  = "admin"
+)
+
+var scopeLevels = map[string]int{
+	scopeRead:   1,
+	scopeSubmit: 2,
+	scopeAdmin:  3,
+}
+
+// Auth configures authentication of API and web pages, if it's enabled,
+// requests should have token in Authorization: Bearer <token> header, badges
+// and status pages also accept token query parameter:
+//
+//	[auth]
+//	  enabled = true
+//	  anonymous = true
+//	  file = "/etc/uroboros/tokens.conf"
+//	  [[auth.tokens]]
+//	    name = "jenkins"
+//	    token = "..."
+//	    scopes = ["submit"]
+//
+// Token file has only tokens section. Anonymous allows reading badges and
+// status pages without token. If authentication is disabled, everyone can
+// read and submit tasks, web.admin_token is a token with admin scope.
+type Auth struct {
+	Enabled   bool
+	Anonymous bool
+	File      string
+	Tokens    []Token
+}
+
+// Token is an API token with scopes, name is used only in logs.
+type Token struct {
+	Name   string
+	Token  string
+	Scopes []string
+}
+
+type tokensFile struct {
+	Tokens []Token
+}
+
+// loadTokens validates tokens from config and loads tokens from the token
+// file, admin token is added as token with admin scope.
+func loadTokens(auth Auth, adminToken string) ([]Token, error) {
+	tokens := append([]Token{}, auth.Tokens...)
+
+	if auth.File != "" {
+		var file tokensFile
+		err := ko.Load(auth.File, &file)
+		if err != nil {
+			return nil, hierr.Errorf(
+				err, "can't load tokens from %s", auth.File,
+			)
+		}
+
+		tokens = append(tokens, file.Tokens...)
+	}
+
+	if adminToken != "" {
+		tokens = append(tokens, Token{
+			Name:   "admin",
+			Token:  adminToken,
+			Scopes: []string{scopeAdmin},
+		})
+	}
+
+	for _, token := range tokens {
+		if token.Token == "" {
+			return nil, fmt.Errorf("token %s is empty", token.Name)
+		}
+
+		for _, scope := range token.Scopes {
+			if _, ok := scopeLevels[scope]; !ok {
+				return nil, fmt.Errorf(
+					"token %s has unknown scope '%s', expected %s, %s or %s",
+					token.Name, scope, scopeRead, scopeSubmit, scopeAdmin,
+				)
+			}
+		}
+	}
+
+	return tokens, nil
+}
+
+// hasScope returns true if the token has the scope or the scope which
+// includes it.
+func (token Token) hasScope(scope string) bool {
+	for _, name := range token.Scopes {
+		if scopeLevels[name] >= scopeLevels[scope] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authorize checks that the request is allowed to access resources of the
+// given scope, returns http.StatusOK if it's allowed,
+// http.StatusUnauthorized if the request has no valid token and
+// http.StatusForbidden if the token doesn't have the scope.
+func (server *WebServer) authorize(request *http.Request, scope string) int {
+	resources := server.getResources()
+
+	if !resources.config.Auth.Enabled && scope != scopeAdmin {
+		return http.StatusOK
+	}
+
+	given := strings.TrimPrefix(
+		request.Header.Get("Authorization"), "Bearer ",
+	)
+
+	return resources.checkToken(given, scope)
+}
+
+// authorizeWeb checks that the request is allowed to read badges and status
+// pages, returns status like authorize.
+func (server *WebServer) authorizeWeb(request *http.Request) int {
+	config := server.getResources().config.Auth
+	if !config.Enabled || config.Anonymous {
+		return http.StatusOK
+	}
+
+	status := server.authorize(request, scopeRead)
+	if status != http.StatusUnauthorized {
+		return status
+	}
+
+	return server.getResources().checkToken(
+		request.URL.Query().Get("token"), scopeRead,
+	)
+}
+
+func (resources *resources) checkToken(given string, scope string) int {
+	if given == "" {
+		return http.StatusUnauthorized
+	}
+
+	for _, token := range resources.tokens {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token.Token)) != 1 {
+			continue
+		}
+
+		if !token.hasScope(scope) {
+			return http.StatusForbidden
+		}
+
+		return http.StatusOK
+	}
+
+	return http.StatusUnauthorized
+}
+
+// writeUnauthorized adds challenge which is required by responses with
+// http.StatusUnauthorized.
+func writeUnauthorized(writer http.ResponseWriter, status int) {
+	if status == http.StatusUnauthorized {
+		writer.Header().Set("WWW-Authenticate", "Bearer")
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kovetskiy/lorg"
+)
+
+func TestLoadTokens(t *testing.T) {
+	tests := []struct {
+		name       string
+		auth       Auth
+		adminToken string
+		expected   int
+		fails      bool
+	}{
+		{
+			name: "config tokens",
+			auth: Auth{Tokens: []Token{
+				{Name: "ci", Token: "ci-token", Scopes: []string{scopeSubmit}},
+				{Name: "viewer", Token: "view-token", Scopes: []string{scopeRead}},
+			}},
+			expected: 2,
+		},
+		{
+			name:       "admin token is added",
+			auth:       Auth{},
+			adminToken: "admin-token",
+			expected:   1,
+		},
+		{
+			name: "empty token",
+			auth: Auth{Tokens: []Token{
+				{Name: "ci", Scopes: []string{scopeSubmit}},
+			}},
+			fails: true,
+		},
+		{
+			name: "unknown scope",
+			auth: Auth{Tokens: []Token{
+				{Name: "ci", Token: "ci-token", Scopes: []string{"write"}},
+			}},
+			fails: true,
+		},
+	}
+
+	for _, test := range tests {
+		tokens, err := loadTokens(test.auth, test.adminToken)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: tokens are loaded, expected error", test.name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		if len(tokens) != test.expected {
+			t.Errorf(
+				"%s: loaded %d tokens, expected %d",
+				test.name, len(tokens), test.expected,
+			)
+		}
+
+		for _, token := range tokens {
+			if token.Token == test.adminToken && !token.hasScope(scopeAdmin) {
+				t.Errorf("%s: admin token has no admin scope", test.name)
+			}
+		}
+	}
+}
+
+func TestToken_HasScope(t *testing.T) {
+	tests := []struct {
+		scopes   []string
+		scope    string
+		expected bool
+	}{
+		{[]string{scopeRead}, scopeRead, true},
+		{[]string{scopeRead}, scopeSubmit, false},
+		{[]string{scopeRead}, scopeAdmin, false},
+		{[]string{scopeSubmit}, scopeRead, true},
+		{[]string{scopeSubmit}, scopeSubmit, true},
+		{[]string{scopeSubmit}, scopeAdmin, false},
+		{[]string{scopeAdmin}, scopeRead, true},
+		{[]string{scopeAdmin}, scopeSubmit, true},
+		{[]string{scopeAdmin}, scopeAdmin, true},
+		{[]string{scopeRead, scopeAdmin}, scopeSubmit, true},
+		{[]string{}, scopeRead, false},
+	}
+
+	for _, test := range tests {
+		token := Token{Name: "test", Token: "token", Scopes: test.scopes}
+		if token.hasScope(test.scope) != test.expected {
+			t.Errorf(
+				"token with scopes %q has scope %s: %t, expected %t",
+				test.scopes, test.scope, !test.expected, test.expected,
+			)
+		}
+	}
+}
+
+func newAuthTestServer(enabled, anonymous bool) *WebServer {
+	resources := &resources{
+		config: &config{Auth: Auth{Enabled: enabled, Anonymous: anonymous}},
+		tokens: []Token{
+			{Name: "viewer", Token: "read-token", Scopes: []string{scopeRead}},
+			{Name: "ci", Token: "submit-token", Scopes: []string{scopeSubmit}},
+			{Name: "admin", Token: "admin-token", Scopes: []string{scopeAdmin}},
+		},
+	}
+
+	return NewWebServer(lorg.NewLog(), resources, nil)
+}
+
+func newAuthTestRequest(header, query string) *http.Request {
+	url := "/status/1"
+	if query != "" {
+		url += "?token=" + query
+	}
+
+	request := httptest.NewRequest("GET", url, nil)
+	if header != "" {
+		request.Header.Set("Authorization", "Bearer "+header)
+	}
+
+	return request
+}
+
+func TestWebServer_Authorize(t *testing.T) {
+	tests := []struct {
+		enabled  bool
+		token    string
+		scope    string
+		expected int
+	}{
+		{false, "", scopeRead, http.StatusOK},
+		{false, "", scopeSubmit, http.StatusOK},
+		{false, "", scopeAdmin, http.StatusUnauthorized},
+		{false, "admin-token", scopeAdmin, http.StatusOK},
+		{true, "", scopeRead, http.StatusUnauthorized},
+		{true, "bad-token", scopeRead, http.StatusUnauthorized},
+		{true, "read-token", scopeRead, http.StatusOK},
+		{true, "read-token", scopeSubmit, http.StatusForbidden},
+		{true, "submit-token", scopeSubmit, http.StatusOK},
+		{true, "submit-token", scopeAdmin, http.StatusForbidden},
+		{true, "admin-token", scopeAdmin, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		server := newAuthTestServer(test.enabled, false)
+
+		status := server.authorize(newAuthTestRequest(test.token, ""), test.scope)
+		if status != test.expected {
+			t.Errorf(
+				"enabled %t, token %q, scope %s: %d, expected %d",
+				test.enabled, test.token, test.scope, status, test.expected,
+			)
+		}
+	}
+}
+
+func TestWebServer_AuthorizeWeb(t *testing.T) {
+	tests := []struct {
+		anonymous bool
+		header    string
+		query     string
+		expected  int
+	}{
+		{true, "", "", http.StatusOK},
+		{false, "", "", http.StatusUnauthorized},
+		{false, "bad-token", "", http.StatusUnauthorized},
+		{false, "read-token", "", http.StatusOK},
+		{false, "", "read-token", http.StatusOK},
+		{false, "", "bad-token", http.StatusUnauthorized},
+		{false, "bad-token", "submit-token", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		server := newAuthTestServer(true, test.anonymous)
+
+		status := server.authorizeWeb(newAuthTestRequest(test.header, test.query))
+		if status != test.expected {
+			t.Errorf(
+				"anonymous %t, header %q, query %q: %d, expected %d",
+				test.anonymous, test.header, test.query, status, test.expected,
+			)
+		}
+	}
+}
+
+func TestWebServer_UnauthorizedRequestHasChallenge(t *testing.T) {
+	tests := []struct {
+		method    string
+		path      string
+		token     string
+		expected  int
+		challenge bool
+	}{
+		{"GET", pathAPI + "tasks/", "", http.StatusUnauthorized, true},
+		{"GET", pathAPI + "tasks/", "bad-token", http.StatusUnauthorized, true},
+		{"POST", pathAPI + "tasks/", "read-token", http.StatusForbidden, false},
+		{"GET", pathStatus + "1", "", http.StatusUnauthorized, true},
+	}
+
+	for _, test := range tests {
+		server := newAuthTestServer(true, false)
+
+		request := httptest.NewRequest(test.method, test.path, nil)
+		if test.token != "" {
+			request.Header.Set("Authorization", "Bearer "+test.token)
+		}
+
+		recorder := httptest.NewRecorder()
+		server.mux.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.expected {
+			t.Errorf(
+				"%s %s with token %q: %d, expected %d",
+				test.method, test.path, test.token, recorder.Code, test.expected,
+			)
+		}
+
+		challenge := recorder.Header().Get("WWW-Authenticate")
+		if (challenge == "Bearer") != test.challenge {
+			t.Errorf(
+				"%s %s with token %q: WWW-Authenticate is %q",
+				test.method, test.path, test.token, challenge,
+			)
+		}
+	}
+}
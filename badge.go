@@ -1 +1,184 @@
 package main
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"time"
+)
+
+const (
+	badgeColorGreen  = "#4c1"
+	badgeColorYellow = "#dfb317"
+	badgeColorOrange = "#fe7d37"
+	badgeColorRed    = "#e05d44"
+	badgeColorBlue   = "#007ec6"
+	badgeColorGrey   = "#9f9f9f"
+)
+
+// Values which can be shown on the task badge, specified by value query
+// parameter.
+const (
+	badgeValueState    = "state"
+	badgeValueDuration = "duration"
+	badgeValueCoverage = "coverage"
+	badgeValueTests    = "tests"
+)
+
+var templateBadgeSVG = template.Must(template.New("").Parse(
+	`<svg xmlns="http://www.w3.org/2000/svg" width="{{ .width }}" height="20">` +
+		`<linearGradient id="b" x2="0" y2="100%">` +
+		`<stop offset="0" stop-color="#bbb" stop-opacity=".1"/>` +
+		`<stop offset="1" stop-opacity=".1"/></linearGradient>` +
+		`<mask id="a"><rect width="{{ .width }}" height="20" rx="3" fill="#fff"/></mask>` +
+		`<g mask="url(#a)">` +
+		`<path fill="#555" d="M0 0h{{ .label_width }}v20H0z"/>` +
+		`<path fill="{{ .color }}" d="M{{ .label_width }} 0h{{ .message_width }}v20H{{ .label_width }}z"/>` +
+		`<path fill="url(#b)" d="M0 0h{{ .width }}v20H0z"/></g>` +
+		`<g fill="#fff" text-anchor="middle" ` +
+		`font-family="DejaVu Sans,Verdana,Geneva,sans-serif" font-size="11">` +
+		`<text x="{{ .label_x }}" y="15" fill="#010101" fill-opacity=".3">{{ .label }}</text>` +
+		`<text x="{{ .label_x }}" y="14">{{ .label }}</text>` +
+		`<text x="{{ .message_x }}" y="15" fill="#010101" fill-opacity=".3">{{ .message }}</text>` +
+		`<text x="{{ .message_x }}" y="14">{{ .message }}</text></g></svg>`,
+))
+
+// renderBadge renders shields-style SVG badge, width of text is approximated
+// because there is no font metrics at hand.
+func renderBadge(label, message, color string) ([]byte, error) {
+	var (
+		labelWidth   = getBadgeTextWidth(label)
+		messageWidth = getBadgeTextWidth(message)
+		buffer       = &bytes.Buffer{}
+	)
+
+	err := templateBadgeSVG.Execute(buffer, map[string]interface{}{
+		"width":         labelWidth + messageWidth,
+		"label":         template.HTMLEscapeString(label),
+		"label_width":   labelWidth,
+		"label_x":       float64(labelWidth) / 2,
+		"message":       template.HTMLEscapeString(message),
+		"message_width": messageWidth,
+		"message_x":     float64(labelWidth) + float64(messageWidth)/2,
+		"color":         color,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func getBadgeTextWidth(text string) int {
+	return len([]rune(text))*7 + 10
+}
+
+// getCoverageBadge returns message and color of coverage badge, coverage
+// below 50% is red and 80% and above is green.
+func getCoverageBadge(report *CoverageReport) (string, string) {
+	if report == nil {
+		return "unknown", badgeColorGrey
+	}
+
+	message := fmt.Sprintf("%.1f%%", report.Coverage)
+
+	switch {
+	case report.Coverage >= 80:
+		return message, badgeColorGreen
+
+	case report.Coverage >= 65:
+		return message, badgeColorYellow
+
+	case report.Coverage >= 50:
+		return message, badgeColorOrange
+
+	default:
+		return message, badgeColorRed
+	}
+}
+
+// getStateBadge returns message and color of the badge for given task state.
+func getStateBadge(state TaskState) (string, string) {
+	switch state {
+	case TaskStateAwaitingApproval:
+		return "awaiting approval", badgeColorOrange
+
+	case TaskStateQueued:
+		return "queued", badgeColorGrey
+
+	case TaskStateProcessing:
+		return "processing", badgeColorBlue
+
+	case TaskStateError:
+		return "failure", badgeColorRed
+
+	case TaskStateSuccess:
+		return "passing", badgeColorGreen
+
+	case TaskStateCancelled:
+		return "cancelled", badgeColorGrey
+
+	case TaskStateTimedOut:
+		return "timed out", badgeColorRed
+
+	default:
+		return "unknown", badgeColorGrey
+	}
+}
+
+// getTaskBadge returns default label, message and color of the badge which
+// shows given value of the task.
+func getTaskBadge(task Task, value string) (string, string, string, error) {
+	switch value {
+	case "", badgeValueState:
+		message, color := getStateBadge(task.GetState())
+		return "build", message, color, nil
+
+	case badgeValueDuration:
+		if task.GetStartedAt().IsZero() {
+			return "duration", "n/a", badgeColorGrey, nil
+		}
+
+		finishedAt := task.GetFinishedAt()
+		if finishedAt.IsZero() {
+			finishedAt = time.Now()
+		}
+
+		return "duration",
+			finishedAt.Sub(task.GetStartedAt()).Round(time.Second).String(),
+			badgeColorBlue,
+			nil
+
+	case badgeValueCoverage:
+		message, color := getCoverageBadge(task.GetCoverage())
+		return "coverage", message, color, nil
+
+	case badgeValueTests:
+		if task.GetTestReport() == nil {
+			return "tests", "n/a", badgeColorGrey, nil
+		}
+
+		passed, failed, skipped := task.GetTestReport().GetCounts()
+		if failed > 0 {
+			return "tests",
+				fmt.Sprintf("%d passed, %d failed", passed, failed),
+				badgeColorRed,
+				nil
+		}
+
+		message := fmt.Sprintf("%d passed", passed)
+		if skipped > 0 {
+			message += fmt.Sprintf(", %d skipped", skipped)
+		}
+
+		return "tests", message, badgeColorGreen, nil
+
+	default:
+		return "", "", "", fmt.Errorf(
+			"unknown badge value '%s', expected %s, %s, %s or %s",
+			value,
+			badgeValueState, badgeValueDuration,
+			badgeValueCoverage, badgeValueTests,
+		)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kovetskiy/lorg"
+)
+
+// Branches pushes builds of watched branches into the queue when new commits
+// are pushed to them, pushes are detected either by polling Stash or by
+// Stash webhooks.
+type Branches struct {
+	logger   *lorg.Log
+	queue    *Queue
+	stashAPI *StashAPI
+	watch    []string
+	interval time.Duration
+	heads    map[string]string
+	mutex    *sync.Mutex
+}
+
+func NewBranches(logger *lorg.Log, queue *Queue) *Branches {
+	return &Branches{
+		logger: logger,
+		queue:  queue,
+		heads:  map[string]string{},
+		mutex:  &sync.Mutex{},
+	}
+}
+
+// SetWatch sets URLs of watched branches and poll interval, zero interval
+// disables polling.
+func (branches *Branches) SetWatch(
+	stashAPI *StashAPI,
+	watch []string,
+	interval time.Duration,
+) {
+	branches.mutex.Lock()
+	defer branches.mutex.Unlock()
+
+	branches.stashAPI = stashAPI
+	branches.watch = watch
+	branches.interval = interval
+}
+
+// Watch periodically polls heads of watched branches and pushes builds of
+// branches which heads are changed.
+func (branches *Branches) Watch() {
+	for {
+		branches.mutex.Lock()
+		interval := branches.interval
+		branches.mutex.Unlock()
+
+		if interval <= 0 {
+			time.Sleep(time.Minute)
+			continue
+		}
+
+		time.Sleep(interval)
+
+		branches.poll()
+	}
+}
+
+func (branches *Branches) poll() {
+	branches.mutex.Lock()
+	var (
+		watch    = branches.watch
+		stashAPI = branches.stashAPI
+	)
+	branches.mutex.Unlock()
+
+	for _, url := range watch {
+		task, err := NewTaskStashBranch(url)
+		if err != nil {
+			branches.logger.Error(err)
+			continue
+		}
+
+		commit, err := stashAPI.GetBranchHead(
+			task.Project, task.Repository, task.Branch,
+		)
+		if err != nil {
+			branches.logger.Errorf(
+				"can't obtain head of branch %s: %s",
+				task.GetIdentifier(), err,
+			)
+			continue
+		}
+
+		branches.push(task, commit)
+	}
+}
+
+// Push pushes builds of watched branches of the given repository which
+// heads are changed to the given commit, branch is a name of branch or a
+// name of ref, like refs/heads/master. Returns unique ids of queued tasks.
+func (branches *Branches) Push(
+	project, repository, branch, commit string,
+) []int64 {
+	branches.mutex.Lock()
+	watch := branches.watch
+	branches.mutex.Unlock()
+
+	branch = strings.TrimPrefix(branch, "refs/heads/")
+
+	queued := []int64{}
+	for _, url := range watch {
+		task, err := NewTaskStashBranch(url)
+		if err != nil {
+			branches.logger.Error(err)
+			continue
+		}
+
+		if !strings.EqualFold(task.Project, project) ||
+			task.Repository != repository ||
+			task.Branch != branch {
+			continue
+		}
+
+		id, ok := branches.push(task, commit)
+		if ok {
+			queued = append(queued, id)
+		}
+	}
+
+	return queued
+}
+
+// push queues the task if branch head differs from the previously built
+// one and the branch build is not already queued.
+func (branches *Branches) push(task *TaskStashBranch, commit string) (
+	int64, bool,
+) {
+	branches.mutex.Lock()
+	defer branches.mutex.Unlock()
+
+	if branches.heads[task.GetIdentifier()] == commit {
+		return 0, false
+	}
+
+	branches.heads[task.GetIdentifier()] = commit
+
+	task.SetPriority(
+		branches.queue.GetDefaultPriority(task, triggerPush),
+	)
+
+	id, queued := branches.queue.PushOnce(task)
+	if !queued {
+		branches.logger.Infof(
+			"branch %s moved to %s, build task#%d is already queued",
+			task.GetIdentifier(), commit, id,
+		)
+
+		return id, false
+	}
+
+	branches.logger.Infof(
+		"branch %s moved to %s, queued build task#%d",
+		task.GetIdentifier(), commit, id,
+	)
+
+	return id, true
+}
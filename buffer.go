@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Buffer is a bytes.Buffer which is safe for concurrent use, logs of the task
+// are written by processor or by agent API handlers while they are read by
+// API handlers, status pages and agent uploads.
+type Buffer struct {
+	buffer bytes.Buffer
+	mutex  sync.Mutex
+}
+
+func (buffer *Buffer) Write(data []byte) (int, error) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	return buffer.buffer.Write(data)
+}
+
+func (buffer *Buffer) WriteString(data string) (int, error) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	return buffer.buffer.WriteString(data)
+}
+
+// Bytes returns copy of the buffer contents, so it can be used while the
+// buffer is written.
+func (buffer *Buffer) Bytes() []byte {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	return append([]byte{}, buffer.buffer.Bytes()...)
+}
+
+func (buffer *Buffer) String() string {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	return buffer.buffer.String()
+}
+
+func (buffer *Buffer) Len() int {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	return buffer.buffer.Len()
+}
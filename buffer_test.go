@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBuffer_ConcurrentWriteAndRead(t *testing.T) {
+	var (
+		buffer  Buffer
+		writers sync.WaitGroup
+		done    = make(chan struct{})
+		read    = make(chan struct{})
+	)
+
+	go func() {
+		defer close(read)
+
+		offset := 0
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			data := buffer.Bytes()
+			if len(data) < offset {
+				t.Errorf("buffer shrunk from %d to %d", offset, len(data))
+				return
+			}
+
+			offset = len(data)
+
+			_ = buffer.String()
+		}
+	}()
+
+	for i := 0; i < 4; i++ {
+		writers.Add(1)
+		go func(i int) {
+			defer writers.Done()
+
+			for j := 0; j < 1000; j++ {
+				fmt.Fprintf(&buffer, "writer %d line %d\n", i, j)
+			}
+		}(i)
+	}
+
+	writers.Wait()
+	close(done)
+	<-read
+
+	lines := strings.Count(buffer.String(), "\n")
+	if lines != 4000 {
+		t.Fatalf("expected 4000 lines, got %d", lines)
+	}
+}
+
+func TestBuffer_TaskLogsWrittenByAgentsAndRead(t *testing.T) {
+	task, err := NewTaskStashBranch(
+		"http://git.local/projects/PRJ/repos/repo/browse?at=refs/heads/master",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var workers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		workers.Add(2)
+
+		go func() {
+			defer workers.Done()
+
+			for j := 0; j < 100; j++ {
+				task.GetBuffer().WriteString("logs\n")
+				task.GetErrorBuffer().WriteString("errors\n")
+			}
+		}()
+
+		go func() {
+			defer workers.Done()
+
+			for j := 0; j < 100; j++ {
+				_ = task.GetBuffer().String()
+				_ = task.GetErrorBuffer().Bytes()
+			}
+		}()
+	}
+
+	workers.Wait()
+
+	if task.GetBuffer().Len() != 4*100*len("logs\n") {
+		t.Fatalf("unexpected length of logs: %d", task.GetBuffer().Len())
+	}
+}
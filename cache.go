@@ -19,10 +19,16 @@ var (
 )
 
 func (cache *cacheHash) Get(path ...string) string {
+	cache.Lock()
+	defer cache.Unlock()
+
 	value, _ := cache.hash.GetString(path...)
 	return value
 }
 
 func (cache *cacheHash) Set(value string, path ...string) {
+	cache.Lock()
+	defer cache.Unlock()
+
 	cache.hash.Set(value, path...)
 }
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// coverageHistorySize is amount of last coverage results per repository
+// branch which are kept.
+const coverageHistorySize = 100
+
+type CoveragePackage struct {
+	Name       string   `json:"name"`
+	Coverage   float64  `json:"coverage"`
+	Statements int      `json:"statements"`
+	Covered    int      `json:"covered"`
+	Delta      *float64 `json:"delta,omitempty"`
+}
+
+type CoverageReport struct {
+	Branch     string            `json:"branch"`
+	Commit     string            `json:"commit"`
+	Coverage   float64           `json:"coverage"`
+	Statements int               `json:"statements"`
+	Covered    int               `json:"covered"`
+	Delta      *float64          `json:"delta,omitempty"`
+	Packages   []CoveragePackage `json:"packages"`
+}
+
+type CoverageRecord struct {
+	TaskID     int64
+	FinishedAt time.Time
+	Report     *CoverageReport
+}
+
+// CoverageHistory keeps coverage of successful branch builds per repository
+// and branch, it's used as a baseline for pull requests to these branches.
+type CoverageHistory struct {
+	mutex   *sync.Mutex
+	records map[string]map[string][]CoverageRecord
+}
+
+func NewCoverageHistory() *CoverageHistory {
+	return &CoverageHistory{
+		mutex:   &sync.Mutex{},
+		records: map[string]map[string][]CoverageRecord{},
+	}
+}
+
+// Add records coverage of the branch build if it is built successfully,
+// coverage of pull requests is never recorded, because source branch of pull
+// request can have the same name as a branch of the target repository.
+func (history *CoverageHistory) Add(task Task) {
+	branch, ok := task.(*TaskStashBranch)
+	if !ok {
+		return
+	}
+
+	report := task.GetCoverage()
+	if report == nil || task.GetState() != TaskStateSuccess {
+		return
+	}
+
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	slug := getRepositorySlug(task)
+	if _, ok := history.records[slug]; !ok {
+		history.records[slug] = map[string][]CoverageRecord{}
+	}
+
+	records := append(history.records[slug][branch.Branch], CoverageRecord{
+		TaskID:     task.GetUniqueID(),
+		FinishedAt: task.GetFinishedAt(),
+		Report:     report,
+	})
+	if len(records) > coverageHistorySize {
+		records = records[len(records)-coverageHistorySize:]
+	}
+
+	history.records[slug][branch.Branch] = records
+}
+
+// GetLatest returns coverage of the latest successful build of the given
+// repository branch or nil if the branch was never built.
+func (history *CoverageHistory) GetLatest(
+	slug string,
+	branch string,
+) *CoverageReport {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	records := history.records[slug][branch]
+	if len(records) == 0 {
+		return nil
+	}
+
+	return records[len(records)-1].Report
+}
+
+// GetRecords returns coverage of successful builds of the given repository
+// branch from the oldest to the latest.
+func (history *CoverageHistory) GetRecords(
+	slug string,
+	branch string,
+) []CoverageRecord {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	return append([]CoverageRecord{}, history.records[slug][branch]...)
+}
+
+// parseCoverageQuery splits query <host>/<project>/<repository>/<branch> into
+// repository slug and branch, branch may contain slashes.
+func parseCoverageQuery(query string) (string, string, error) {
+	parts := strings.SplitN(query, "/", 4)
+	if len(parts) != 4 || parts[3] == "" {
+		return "", "", fmt.Errorf(
+			"invalid query '%s', expected <host>/<project>/<repository>/<branch>",
+			query,
+		)
+	}
+
+	return strings.Join(parts[:3], "/"), parts[3], nil
+}
+
+// parseCoverProfile calculates total and per-package coverage using profile
+// written by go test -coverprofile, blocks which are reported several times
+// are counted once.
+func parseCoverProfile(profile string) (*CoverageReport, error) {
+	type block struct {
+		statements int
+		covered    bool
+	}
+
+	blocks := map[string]map[string]block{}
+
+	for i, line := range strings.Split(profile, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "mode:") {
+			continue
+		}
+
+		// github.com/org/repo/file.go:10.2,12.16 2 1
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf(
+				"can't parse coverage profile line %d: %q", i+1, line,
+			)
+		}
+
+		separator := strings.LastIndex(fields[0], ":")
+		if separator < 0 {
+			return nil, fmt.Errorf(
+				"can't parse coverage profile line %d: %q", i+1, line,
+			)
+		}
+
+		statements, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf(
+				"can't parse coverage profile line %d: %s", i+1, err,
+			)
+		}
+
+		count, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf(
+				"can't parse coverage profile line %d: %s", i+1, err,
+			)
+		}
+
+		pkg := path.Dir(fields[0][:separator])
+		if _, ok := blocks[pkg]; !ok {
+			blocks[pkg] = map[string]block{}
+		}
+
+		previous := blocks[pkg][fields[0]]
+
+		blocks[pkg][fields[0]] = block{
+			statements: statements,
+			covered:    previous.covered || count > 0,
+		}
+	}
+
+	report := &CoverageReport{Packages: []CoveragePackage{}}
+
+	for name, pkgBlocks := range blocks {
+		pkg := CoveragePackage{Name: name}
+		for _, block := range pkgBlocks {
+			pkg.Statements += block.statements
+			if block.covered {
+				pkg.Covered += block.statements
+			}
+		}
+
+		pkg.Coverage = getCoveragePercent(pkg.Covered, pkg.Statements)
+
+		report.Statements += pkg.Statements
+		report.Covered += pkg.Covered
+		report.Packages = append(report.Packages, pkg)
+	}
+
+	sort.Slice(report.Packages, func(i, j int) bool {
+		return report.Packages[i].Name < report.Packages[j].Name
+	})
+
+	report.Coverage = getCoveragePercent(report.Covered, report.Statements)
+
+	return report, nil
+}
+
+// Compare calculates coverage delta between the report and the target
+// report, packages which are not present in the target are left without
+// delta.
+func (report *CoverageReport) Compare(target *CoverageReport) {
+	delta := report.Coverage - target.Coverage
+	report.Delta = &delta
+
+	targets := map[string]CoveragePackage{}
+	for _, pkg := range target.Packages {
+		targets[pkg.Name] = pkg
+	}
+
+	for i, pkg := range report.Packages {
+		target, ok := targets[pkg.Name]
+		if !ok {
+			continue
+		}
+
+		delta := pkg.Coverage - target.Coverage
+		report.Packages[i].Delta = &delta
+	}
+}
+
+// String returns total coverage with delta if it's known, e.g. 75.2% (+1.3%).
+func (report *CoverageReport) String() string {
+	if report.Delta == nil {
+		return fmt.Sprintf("%.1f%%", report.Coverage)
+	}
+
+	return fmt.Sprintf("%.1f%% (%+.1f%%)", report.Coverage, *report.Delta)
+}
+
+func getCoveragePercent(covered, statements int) float64 {
+	if statements == 0 {
+		return 0
+	}
+
+	return float64(covered) * 100 / float64(statements)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+)
+
+func newCoverageTask(
+	t *testing.T,
+	url string,
+	branch string,
+	coverage float64,
+) Task {
+	task, err := NewTaskFromURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	task.SetState(TaskStateSuccess)
+	task.SetCoverage(&CoverageReport{
+		Branch:     branch,
+		Coverage:   coverage,
+		Statements: 100,
+		Covered:    int(coverage),
+		Packages: []CoveragePackage{
+			{
+				Name:       "pkg",
+				Coverage:   coverage,
+				Statements: 100,
+				Covered:    int(coverage),
+			},
+		},
+	})
+
+	return task
+}
+
+func TestCoverageHistory_BaselineComesFromTargetBranch(t *testing.T) {
+	history := NewCoverageHistory()
+
+	master := newCoverageTask(
+		t,
+		"http://git.local/projects/PRJ/repos/repo/browse?at=refs/heads/master",
+		"master", 80,
+	)
+
+	// pull request from branch which is named the same as the target branch
+	// of other pull requests.
+	pullRequest := newCoverageTask(
+		t,
+		"http://git.local/projects/PRJ/repos/repo/pull-requests/1/overview",
+		"master", 10,
+	)
+
+	history.Add(master)
+	history.Add(pullRequest)
+
+	slug := getRepositorySlug(master)
+
+	baseline := history.GetLatest(slug, "master")
+	if baseline == nil {
+		t.Fatal("coverage of target branch is not recorded")
+	}
+
+	if baseline.Coverage != 80 {
+		t.Fatalf(
+			"baseline should be build of target branch with 80%% coverage, "+
+				"got %.1f%%",
+			baseline.Coverage,
+		)
+	}
+
+	report := pullRequest.GetCoverage()
+	report.Compare(baseline)
+
+	if report.Delta == nil || *report.Delta != -70 {
+		t.Fatalf("unexpected delta comparing to target branch: %v", report.Delta)
+	}
+}
+
+func TestCoverageHistory_PullRequestsAreNotRecorded(t *testing.T) {
+	history := NewCoverageHistory()
+
+	history.Add(newCoverageTask(
+		t,
+		"http://git.local/projects/PRJ/repos/repo/pull-requests/1/overview",
+		"feature", 50,
+	))
+
+	if history.GetLatest("git.local/prj/repo", "feature") != nil {
+		t.Fatal("coverage of pull request is recorded as branch coverage")
+	}
+}
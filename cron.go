@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed cron expression of five fields: minute, hour,
+// day of month, month and day of week. Every field is either *, a number,
+// a range like 1-5, a step like */15 or 1-30/5, or a comma-separated list
+// of those. Day of week is 0-6 starting from Sunday, 7 is also Sunday.
+type cronSchedule struct {
+	minutes  map[int]bool
+	hours    map[int]bool
+	days     map[int]bool
+	months   map[int]bool
+	weekdays map[int]bool
+
+	// anyDay and anyWeekday are true if the field is *, if both day of
+	// month and day of week are restricted, time matches if either of them
+	// matches, like in cron.
+	anyDay     bool
+	anyWeekday bool
+}
+
+func parseCronSchedule(expression string) (*cronSchedule, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf(
+			"cron expression '%s' should have 5 fields, got %d",
+			expression, len(fields),
+		)
+	}
+
+	var (
+		schedule = &cronSchedule{
+			anyDay:     fields[2] == "*",
+			anyWeekday: fields[4] == "*",
+		}
+		err error
+	)
+
+	for _, field := range []struct {
+		name   string
+		value  string
+		min    int
+		max    int
+		result *map[int]bool
+	}{
+		{"minute", fields[0], 0, 59, &schedule.minutes},
+		{"hour", fields[1], 0, 23, &schedule.hours},
+		{"day of month", fields[2], 1, 31, &schedule.days},
+		{"month", fields[3], 1, 12, &schedule.months},
+		{"day of week", fields[4], 0, 7, &schedule.weekdays},
+	} {
+		*field.result, err = parseCronField(field.value, field.min, field.max)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"can't parse %s of cron expression '%s': %s",
+				field.name, expression, err,
+			)
+		}
+	}
+
+	if schedule.weekdays[7] {
+		schedule.weekdays[0] = true
+	}
+
+	return schedule, nil
+}
+
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	values := map[int]bool{}
+
+	for _, part := range strings.Split(field, ",") {
+		var (
+			from = min
+			to   = max
+			step = 1
+			err  error
+		)
+
+		if index := strings.Index(part, "/"); index >= 0 {
+			step, err = strconv.Atoi(part[index+1:])
+			if err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step in '%s'", part)
+			}
+
+			part = part[:index]
+		}
+
+		switch {
+		case part == "*":
+
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+
+			from, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid range '%s'", part)
+			}
+
+			to, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid range '%s'", part)
+			}
+
+		default:
+			from, err = strconv.Atoi(part)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value '%s'", part)
+			}
+
+			if step == 1 {
+				to = from
+			}
+		}
+
+		if from < min || to > max || from > to {
+			return nil, fmt.Errorf(
+				"'%s' is out of range %d-%d", part, min, max,
+			)
+		}
+
+		for value := from; value <= to; value += step {
+			values[value] = true
+		}
+	}
+
+	return values, nil
+}
+
+// Match returns true if the schedule matches the minute of the given time.
+func (schedule *cronSchedule) Match(at time.Time) bool {
+	if !schedule.minutes[at.Minute()] ||
+		!schedule.hours[at.Hour()] ||
+		!schedule.months[int(at.Month())] {
+		return false
+	}
+
+	var (
+		day     = schedule.days[at.Day()]
+		weekday = schedule.weekdays[int(at.Weekday())]
+	)
+
+	switch {
+	case schedule.anyDay && schedule.anyWeekday:
+		return true
+
+	case schedule.anyDay:
+		return weekday
+
+	case schedule.anyWeekday:
+		return day
+
+	default:
+		return day || weekday
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const environmentMask = "******"
+
+// reSecretVariable matches names of variables which values are not recorded
+// on the task.
+var reSecretVariable = regexp.MustCompile(
+	`(?i)(token|secret|password|passwd|credential|key)`,
+)
+
+// Environment configures environment of build commands, commands don't
+// inherit environment of uroboros, they get only PATH, HOME located in the
+// workspace, GOPATH, GOCACHE, host variables listed in passthrough and
+// configured variables:
+//
+//	[environment]
+//	  path = "/usr/local/go/bin:/usr/bin:/bin"
+//	  cache = "/var/cache/uroboros"
+//	  passthrough = ["HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"]
+//	  [environment.variables]
+//	    CGO_ENABLED = "0"
+//
+// PATH of uroboros is used if path is empty. Cache is a directory of build
+// caches which persist between builds, every repository has its own cache.
+// Commands which fetch sources and dependencies additionally get ssh agent,
+// ssh command and proxy variables of uroboros.
+type Environment struct {
+	Path        string
+	Cache       string
+	Passthrough []string
+	Variables   map[string]string
+}
+
+// getBuildCache returns directory of Go build cache of the repository of the
+// task, untrusted builds get a separate cache, so they can't poison cache of
+// trusted builds.
+func (resources *resources) getBuildCache(task Task, untrusted bool) string {
+	directory := resources.config.Environment.Cache
+	if directory == "" {
+		directory = filepath.Join(os.TempDir(), "uroboros_cache")
+	}
+
+	cache := filepath.Join(
+		directory, filepath.FromSlash(getRepositorySlug(task)),
+	)
+	if untrusted {
+		cache += ".untrusted"
+	}
+
+	return cache
+}
+
+// getEnvironment returns environment of build commands which are run in the
+// given workspace with the given build cache, variables are sorted by name.
+func (resources *resources) getEnvironment(
+	gopath string,
+	cache string,
+) ([]string, error) {
+	config := resources.config.Environment
+
+	home := filepath.Join(gopath, ".home")
+
+	for _, directory := range []string{home, cache} {
+		err := os.MkdirAll(directory, 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	variables := map[string]string{
+		"PATH":    config.Path,
+		"HOME":    home,
+		"GOPATH":  gopath,
+		"GOCACHE": cache,
+	}
+
+	if variables["PATH"] == "" {
+		variables["PATH"] = os.Getenv("PATH")
+	}
+
+	for _, name := range config.Passthrough {
+		if value, ok := os.LookupEnv(name); ok {
+			variables[name] = value
+		}
+	}
+
+	for name, value := range config.Variables {
+		variables[name] = value
+	}
+
+	environment := []string{}
+	for name, value := range variables {
+		environment = append(environment, name+"="+value)
+	}
+
+	sort.Strings(environment)
+
+	return environment, nil
+}
+
+// sourcesPassthrough lists variables of uroboros which are passed to
+// commands which fetch sources and dependencies, so git can authenticate
+// through ssh agent or configured ssh command and use proxy.
+var sourcesPassthrough = []string{
+	"SSH_AUTH_SOCK",
+	"GIT_SSH",
+	"GIT_SSH_COMMAND",
+	"HTTP_PROXY",
+	"HTTPS_PROXY",
+	"NO_PROXY",
+	"http_proxy",
+	"https_proxy",
+	"no_proxy",
+}
+
+// getSourcesEnvironment returns environment of commands which fetch sources
+// and dependencies, it's the given build environment with variables of
+// uroboros listed in sourcesPassthrough.
+func getSourcesEnvironment(environment []string) []string {
+	result := append([]string{}, environment...)
+
+	defined := map[string]bool{}
+	for _, variable := range environment {
+		defined[strings.SplitN(variable, "=", 2)[0]] = true
+	}
+
+	for _, name := range sourcesPassthrough {
+		if value, ok := os.LookupEnv(name); ok && !defined[name] {
+			result = append(result, name+"="+value)
+		}
+	}
+
+	return result
+}
+
+// getRecordedEnvironment returns environment with masked values of variables
+// which look like secrets.
+func getRecordedEnvironment(environment []string) []string {
+	recorded := []string{}
+	for _, variable := range environment {
+		name := strings.SplitN(variable, "=", 2)[0]
+		if reSecretVariable.MatchString(name) {
+			variable = name + "=" + environmentMask
+		}
+
+		recorded = append(recorded, variable)
+	}
+
+	return recorded
+}
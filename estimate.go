@@ -0,0 +1,157 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// historySize is amount of last builds per repository which are used for
+// calculating average build duration.
+const historySize = 10
+
+type History struct {
+	mutex     *sync.Mutex
+	durations map[string][]time.Duration
+}
+
+type Estimate struct {
+	Position int
+	Ahead    int
+	StartAt  time.Time
+	FinishAt time.Time
+}
+
+func NewHistory() *History {
+	return &History{
+		mutex:     &sync.Mutex{},
+		durations: map[string][]time.Duration{},
+	}
+}
+
+func getRepositorySlug(task Task) string {
+	return task.GetHost() + "/" + task.GetProject() + "/" + task.GetRepository()
+}
+
+func (history *History) Add(task Task) {
+	if task.GetStartedAt().IsZero() || task.GetFinishedAt().IsZero() ||
+		task.GetState() == TaskStateCancelled {
+		return
+	}
+
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	slug := getRepositorySlug(task)
+
+	durations := append(
+		history.durations[slug],
+		task.GetFinishedAt().Sub(task.GetStartedAt()),
+	)
+	if len(durations) > historySize {
+		durations = durations[len(durations)-historySize:]
+	}
+
+	history.durations[slug] = durations
+}
+
+// GetDuration returns average duration of builds of the task's repository,
+// falls back to average duration of all builds if there is no builds of the
+// given repository yet. Returns zero if nothing was built yet.
+func (history *History) GetDuration(task Task) time.Duration {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	if durations, ok := history.durations[getRepositorySlug(task)]; ok {
+		return average(durations)
+	}
+
+	all := []time.Duration{}
+	for _, durations := range history.durations {
+		all = append(all, durations...)
+	}
+
+	return average(all)
+}
+
+func average(durations []time.Duration) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+
+	var total time.Duration
+	for _, duration := range durations {
+		total += duration
+	}
+
+	return total / time.Duration(len(durations))
+}
+
+// Estimate calculates position and expected start/finish time of every
+// pending task by simulating how given amount of slots will serve running
+// and pending tasks using average build durations. Concurrency limits are not
+// taken into account. Times are left zero when nothing was built yet.
+func (queue *Queue) Estimate(
+	slots int,
+	history *History,
+) map[int64]Estimate {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	var (
+		now       = time.Now()
+		estimates = map[int64]Estimate{}
+		available = []time.Time{}
+	)
+
+	for i, task := range queue.pending {
+		estimates[task.GetUniqueID()] = Estimate{
+			Position: i + 1,
+			Ahead:    i,
+		}
+	}
+
+	for _, task := range queue.running {
+		duration := history.GetDuration(task)
+		if duration == 0 {
+			return estimates
+		}
+
+		finishAt := task.GetStartedAt().Add(duration)
+		if finishAt.Before(now) {
+			finishAt = now
+		}
+
+		estimates[task.GetUniqueID()] = Estimate{FinishAt: finishAt}
+
+		available = append(available, finishAt)
+	}
+
+	for len(available) < slots {
+		available = append(available, now)
+	}
+
+	if len(available) == 0 {
+		return estimates
+	}
+
+	for _, task := range queue.pending {
+		duration := history.GetDuration(task)
+		if duration == 0 {
+			return estimates
+		}
+
+		sort.Slice(available, func(i, j int) bool {
+			return available[i].Before(available[j])
+		})
+
+		estimate := estimates[task.GetUniqueID()]
+		estimate.StartAt = available[0]
+		estimate.FinishAt = available[0].Add(duration)
+		estimates[task.GetUniqueID()] = estimate
+
+		available[0] = estimate.FinishAt
+	}
+
+	return estimates
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"sort"
+)
+
+type taskExport struct {
+	contentType string
+	convert     func(Task) ([]byte, error)
+}
+
+// taskExportFormats are formats of finished task results which are served
+// by /api/v1/tasks/<id>/<format>.
+var taskExportFormats = map[string]taskExport{
+	"junit": {
+		contentType: "application/xml",
+		convert: func(task Task) ([]byte, error) {
+			return exportJUnit(task.GetTestReport())
+		},
+	},
+	"sarif": {
+		contentType: "application/sarif+json",
+		convert: func(task Task) ([]byte, error) {
+			return exportSARIF(task.GetLintFindings())
+		},
+	},
+	"checkstyle": {
+		contentType: "application/xml",
+		convert: func(task Task) ([]byte, error) {
+			return exportCheckstyle(task.GetLintFindings())
+		},
+	},
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+	SystemOut string          `xml:"system-out,omitempty"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message  string `xml:"message,attr"`
+	Contents string `xml:",chardata"`
+}
+
+// exportJUnit converts test report into JUnit XML, every package becomes a
+// test suite.
+func exportJUnit(report *TestReport) ([]byte, error) {
+	suites := junitTestSuites{Suites: []junitTestSuite{}}
+	if report == nil {
+		return marshalXML(suites)
+	}
+
+	for _, pkg := range report.Packages {
+		suite := junitTestSuite{
+			Name:      pkg.Name,
+			Time:      formatSeconds(pkg.Elapsed),
+			TestCases: []junitTestCase{},
+		}
+
+		for _, test := range pkg.Tests {
+			testcase := junitTestCase{
+				ClassName: pkg.Name,
+				Name:      test.Name,
+				Time:      formatSeconds(test.Elapsed),
+			}
+
+			switch test.Result {
+			case testResultFail:
+				testcase.Failure = &junitMessage{
+					Message:  "failed",
+					Contents: test.Output,
+				}
+				suite.Failures++
+
+			case testResultSkip:
+				testcase.Skipped = &junitMessage{
+					Message:  "skipped",
+					Contents: test.Output,
+				}
+				suite.Skipped++
+
+			default:
+				testcase.SystemOut = test.Output
+			}
+
+			suite.Tests++
+			suite.TestCases = append(suite.TestCases, testcase)
+		}
+
+		// package failed without failed tests, most likely it's not compiled,
+		// so reporting it as failed test case to make it visible.
+		if pkg.Result == testResultFail && suite.Failures == 0 {
+			suite.TestCases = append(suite.TestCases, junitTestCase{
+				ClassName: pkg.Name,
+				Name:      "package",
+				Time:      formatSeconds(pkg.Elapsed),
+				Failure: &junitMessage{
+					Message:  "package failed",
+					Contents: pkg.Output,
+				},
+			})
+
+			suite.Tests++
+			suite.Failures++
+		} else {
+			suite.SystemOut = pkg.Output
+		}
+
+		suites.Suites = append(suites.Suites, suite)
+	}
+
+	return marshalXML(suites)
+}
+
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver struct {
+		Name string `json:"name"`
+	} `json:"driver"`
+}
+
+type sarifResult struct {
+	RuleID  string `json:"ruleId"`
+	Level   string `json:"level"`
+	Message struct {
+		Text string `json:"text"`
+	} `json:"message"`
+	Locations []sarifLocation `json:"locations,omitempty"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation struct {
+		ArtifactLocation struct {
+			URI string `json:"uri"`
+		} `json:"artifactLocation"`
+		Region *sarifRegion `json:"region,omitempty"`
+	} `json:"physicalLocation"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+}
+
+// exportSARIF converts lint findings into SARIF 2.1.0 log, every linter
+// becomes a separate run.
+func exportSARIF(findings []LintFinding) ([]byte, error) {
+	log := sarifLog{
+		Version: "2.1.0",
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Runs:    []sarifRun{},
+	}
+
+	grouped := map[string][]LintFinding{}
+	for _, finding := range findings {
+		grouped[finding.Linter] = append(grouped[finding.Linter], finding)
+	}
+
+	linters := []string{}
+	for linter := range grouped {
+		linters = append(linters, linter)
+	}
+
+	sort.Strings(linters)
+
+	for _, linter := range linters {
+		run := sarifRun{Results: []sarifResult{}}
+		run.Tool.Driver.Name = linter
+
+		for _, finding := range grouped[linter] {
+			result := sarifResult{
+				RuleID: linter,
+				Level:  getLintFindingLevel(finding),
+			}
+
+			result.Message.Text = finding.Message
+
+			if finding.File != "" {
+				var location sarifLocation
+				location.PhysicalLocation.ArtifactLocation.URI = finding.File
+
+				if finding.Line > 0 {
+					location.PhysicalLocation.Region = &sarifRegion{
+						StartLine:   finding.Line,
+						StartColumn: finding.Column,
+					}
+				}
+
+				result.Locations = []sarifLocation{location}
+			}
+
+			run.Results = append(run.Results, result)
+		}
+
+		log.Runs = append(log.Runs, run)
+	}
+
+	return json.MarshalIndent(log, "", "  ")
+}
+
+type checkstyleReport struct {
+	XMLName xml.Name         `xml:"checkstyle"`
+	Version string           `xml:"version,attr"`
+	Files   []checkstyleFile `xml:"file"`
+}
+
+type checkstyleFile struct {
+	Name   string            `xml:"name,attr"`
+	Errors []checkstyleError `xml:"error"`
+}
+
+type checkstyleError struct {
+	Line     int    `xml:"line,attr"`
+	Column   int    `xml:"column,attr,omitempty"`
+	Severity string `xml:"severity,attr"`
+	Message  string `xml:"message,attr"`
+	Source   string `xml:"source,attr"`
+}
+
+// exportCheckstyle converts lint findings into checkstyle XML, findings
+// without file are skipped because checkstyle has no place for them.
+func exportCheckstyle(findings []LintFinding) ([]byte, error) {
+	report := checkstyleReport{
+		Version: "4.3",
+		Files:   []checkstyleFile{},
+	}
+
+	files := map[string][]checkstyleError{}
+	for _, finding := range findings {
+		if finding.File == "" {
+			continue
+		}
+
+		level := getLintFindingLevel(finding)
+		if level == "note" {
+			level = "info"
+		}
+
+		files[finding.File] = append(files[finding.File], checkstyleError{
+			Line:     finding.Line,
+			Column:   finding.Column,
+			Severity: level,
+			Message:  finding.Message,
+			Source:   finding.Linter,
+		})
+	}
+
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		report.Files = append(report.Files, checkstyleFile{
+			Name:   name,
+			Errors: files[name],
+		})
+	}
+
+	return marshalXML(report)
+}
+
+// getLintFindingLevel returns SARIF level of the finding: error, warning or
+// note for findings which don't affect the build result.
+func getLintFindingLevel(finding LintFinding) string {
+	switch {
+	case finding.Informational:
+		return "note"
+
+	case finding.Severity == lintSeverityWarning:
+		return "warning"
+
+	default:
+		return "error"
+	}
+}
+
+func marshalXML(value interface{}) ([]byte, error) {
+	data, err := xml.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), data...), nil
+}
+
+func formatSeconds(seconds float64) string {
+	return fmt.Sprintf("%.3f", seconds)
+}
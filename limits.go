@@ -0,0 +1,63 @@
+package main
+
+// Limits caps amount of tasks which can be processed simultaneously for the
+// same host, project or repository, zero means no limit.
+type Limits struct {
+	Host       int
+	Project    int
+	Repository int
+}
+
+type limiter struct {
+	limits  Limits
+	running map[string]int
+}
+
+type limit struct {
+	key string
+	max int
+}
+
+func newLimiter() *limiter {
+	return &limiter{
+		running: map[string]int{},
+	}
+}
+
+func (limiter *limiter) getLimits(task Task) []limit {
+	var (
+		host       = task.GetHost()
+		project    = host + "/" + task.GetProject()
+		repository = project + "/" + task.GetRepository()
+	)
+
+	return []limit{
+		{key: "host:" + host, max: limiter.limits.Host},
+		{key: "project:" + project, max: limiter.limits.Project},
+		{key: "repository:" + repository, max: limiter.limits.Repository},
+	}
+}
+
+func (limiter *limiter) acquire(task Task) bool {
+	limits := limiter.getLimits(task)
+	for _, limit := range limits {
+		if limit.max > 0 && limiter.running[limit.key] >= limit.max {
+			return false
+		}
+	}
+
+	for _, limit := range limits {
+		limiter.running[limit.key]++
+	}
+
+	return true
+}
+
+func (limiter *limiter) release(task Task) {
+	for _, limit := range limiter.getLimits(task) {
+		limiter.running[limit.key]--
+		if limiter.running[limit.key] <= 0 {
+			delete(limiter.running, limit.key)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	lintSeverityError   = "error"
+	lintSeverityWarning = "warning"
+)
+
+var (
+	reLintPosition = regexp.MustCompile(
+		`^(?:vet: )?([^:\s][^:]*):(\d+)(?::(\d+))?:\s*(.*)$`,
+	)
+	reLintFile = regexp.MustCompile(`^[^\s:]+\.go$`)
+)
+
+// Linter is a command which checks source code, configured in
+// resources.linters section either as a plain command or as a table:
+//
+//	gofmt = "gofmt -s -l ."
+//	gocyclo = { command = "gocyclo -over 15 .", severity = "warning" }
+type Linter struct {
+	Name     string
+	Command  string
+	Severity string
+	Timeout  time.Duration
+	Dir      string
+}
+
+func parseLinters(values map[string]interface{}) (map[string]Linter, error) {
+	linters := map[string]Linter{}
+	for name, value := range values {
+		linter := Linter{
+			Name:     name,
+			Severity: lintSeverityError,
+		}
+
+		switch value := value.(type) {
+		case string:
+			linter.Command = value
+
+		case map[string]interface{}:
+			for key, field := range value {
+				text, ok := field.(string)
+				if !ok {
+					return nil, fmt.Errorf(
+						"linter %s: %s should be a string", name, key,
+					)
+				}
+
+				switch key {
+				case "command":
+					linter.Command = text
+
+				case "severity":
+					linter.Severity = text
+
+				case "dir":
+					linter.Dir = text
+
+				case "timeout":
+					timeout, err := time.ParseDuration(text)
+					if err != nil {
+						return nil, fmt.Errorf(
+							"linter %s: can't parse timeout: %s", name, err,
+						)
+					}
+
+					linter.Timeout = timeout
+
+				default:
+					return nil, fmt.Errorf(
+						"linter %s: unknown option %s", name, key,
+					)
+				}
+			}
+
+		default:
+			return nil, fmt.Errorf(
+				"linter %s should be either a command or a table", name,
+			)
+		}
+
+		if linter.Command == "" {
+			return nil, fmt.Errorf("linter %s: command is not specified", name)
+		}
+
+		if linter.Severity != lintSeverityError &&
+			linter.Severity != lintSeverityWarning {
+			return nil, fmt.Errorf(
+				"linter %s: unknown severity '%s', expected %s or %s",
+				name, linter.Severity, lintSeverityError, lintSeverityWarning,
+			)
+		}
+
+		if filepath.IsAbs(linter.Dir) ||
+			strings.HasPrefix(filepath.Clean(linter.Dir), "..") {
+			return nil, fmt.Errorf(
+				"linter %s: dir should be relative to repository root", name,
+			)
+		}
+
+		linters[name] = linter
+	}
+
+	return linters, nil
+}
+
+// getLinterNames returns sorted names of linters, so linters are always
+// reported in the same order.
+func getLinterNames(linters map[string]Linter) []string {
+	names := []string{}
+	for name := range linters {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+type LintFinding struct {
+	Linter  string `json:"linter"`
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+
+	// Severity is the severity of the linter which reported the finding,
+	// findings with warning severity never fail the build.
+	Severity string `json:"severity"`
+
+	// Informational findings are reported, but don't fail the build.
+	Informational bool `json:"informational,omitempty"`
+}
+
+func (finding LintFinding) String() string {
+	linter := finding.Linter
+	if finding.Severity == lintSeverityWarning {
+		linter += " (warning)"
+	}
+
+	switch {
+	case finding.File == "":
+		return fmt.Sprintf("%s: %s", linter, finding.Message)
+
+	case finding.Line == 0:
+		return fmt.Sprintf(
+			"%s: %s: %s", linter, finding.File, finding.Message,
+		)
+
+	case finding.Column == 0:
+		return fmt.Sprintf(
+			"%s: %s:%d: %s",
+			linter, finding.File, finding.Line, finding.Message,
+		)
+
+	default:
+		return fmt.Sprintf(
+			"%s: %s:%d:%d: %s",
+			linter, finding.File, finding.Line, finding.Column,
+			finding.Message,
+		)
+	}
+}
+
+// parseLintOutput parses output of linter into findings, following formats
+// are recognized:
+//
+//	file:line:col: message  (misspell, ineffassign, golint, vet)
+//	file:line: message      (vet)
+//	... file:line:col       (gocyclo)
+//	file                    (gofmt -l, goimports -l)
+//
+// Lines which don't match any format are reported as informational findings
+// without position, so nothing from the linter output is lost, but noise in
+// output of linter which exited successfully doesn't fail the build.
+func parseLintOutput(linter Linter, output string, root string) []LintFinding {
+	findings := []LintFinding{}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" ||
+			strings.HasPrefix(line, "#") ||
+			strings.HasPrefix(line, "exit status ") {
+			continue
+		}
+
+		finding := LintFinding{
+			Linter:   linter.Name,
+			Severity: linter.Severity,
+			Message:  line,
+		}
+
+		if matches := reLintPosition.FindStringSubmatch(line); matches != nil {
+			finding.File = normalizeLintPath(matches[1], root, linter.Dir)
+			finding.Line, _ = strconv.Atoi(matches[2])
+			finding.Column, _ = strconv.Atoi(matches[3])
+			finding.Message = matches[4]
+
+			// gocyclo puts position at the end of line:
+			// 16 main main.go:10:1
+			if fields := strings.Fields(matches[1]); len(fields) > 1 {
+				finding.File = normalizeLintPath(
+					fields[len(fields)-1], root, linter.Dir,
+				)
+				finding.Message = strings.TrimSpace(
+					strings.Join(fields[:len(fields)-1], " ") + " " +
+						finding.Message,
+				)
+			}
+		} else if reLintFile.MatchString(line) {
+			finding.File = normalizeLintPath(line, root, linter.Dir)
+			finding.Message = "file is not formatted properly"
+		} else {
+			finding.Informational = true
+		}
+
+		findings = append(findings, finding)
+	}
+
+	return findings
+}
+
+// normalizeLintPath converts path reported by linter which runs in the given
+// directory to the path relative to the repository root, which is used by
+// Stash.
+func normalizeLintPath(path string, root string, dir string) string {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	} else if root != "" {
+		relative, err := filepath.Rel(root, path)
+		if err == nil {
+			path = relative
+		}
+	}
+
+	return filepath.ToSlash(filepath.Clean(path))
+}
+
+type lintLineComment struct {
+	File string
+	Line int
+	Text string
+}
+
+// getLintLineComments groups findings by file and line, so every line gets
+// only one comment, identical findings on the same line are collapsed into
+// one with amount of repeats.
+func getLintLineComments(findings []LintFinding) []lintLineComment {
+	type position struct {
+		file string
+		line int
+	}
+
+	var (
+		positions = []position{}
+		messages  = map[position][]string{}
+		repeats   = map[position]map[string]int{}
+	)
+
+	for _, finding := range findings {
+		if finding.File == "" || finding.Line == 0 || finding.Informational {
+			continue
+		}
+
+		key := position{finding.File, finding.Line}
+		if _, ok := repeats[key]; !ok {
+			positions = append(positions, key)
+			repeats[key] = map[string]int{}
+		}
+
+		message := fmt.Sprintf("**%s**: %s", finding.Linter, finding.Message)
+		if finding.Severity == lintSeverityWarning {
+			message = fmt.Sprintf(
+				"**%s** (warning): %s", finding.Linter, finding.Message,
+			)
+		}
+		if repeats[key][message] == 0 {
+			messages[key] = append(messages[key], message)
+		}
+
+		repeats[key][message]++
+	}
+
+	sort.Slice(positions, func(i, j int) bool {
+		if positions[i].file != positions[j].file {
+			return positions[i].file < positions[j].file
+		}
+
+		return positions[i].line < positions[j].line
+	})
+
+	comments := []lintLineComment{}
+	for _, key := range positions {
+		lines := []string{}
+		for _, message := range messages[key] {
+			if count := repeats[key][message]; count > 1 {
+				message = fmt.Sprintf("%s (x%d)", message, count)
+			}
+
+			lines = append(lines, "* "+message)
+		}
+
+		comments = append(comments, lintLineComment{
+			File: key.file,
+			Line: key.line,
+			Text: strings.Join(lines, "\n"),
+		})
+	}
+
+	return comments
+}
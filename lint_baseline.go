@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+const lintModeBaseline = "baseline"
+
+// compareLintFindings marks findings which are also present in the baseline
+// as informational, findings are matched by linter, file and message, line
+// numbers are ignored because they are shifted by changes. Returns amount of
+// new findings and amount of baseline findings which are gone.
+func compareLintFindings(
+	findings []LintFinding,
+	baseline []LintFinding,
+) (int, int) {
+	type key struct {
+		linter  string
+		file    string
+		message string
+	}
+
+	remaining := map[key]int{}
+	for _, finding := range baseline {
+		remaining[key{finding.Linter, finding.File, finding.Message}]++
+	}
+
+	created := 0
+	for i, finding := range findings {
+		if finding.Informational {
+			continue
+		}
+
+		key := key{finding.Linter, finding.File, finding.Message}
+		if remaining[key] > 0 {
+			remaining[key]--
+			findings[i].Informational = true
+			continue
+		}
+
+		created++
+	}
+
+	fixed := 0
+	for _, count := range remaining {
+		fixed += count
+	}
+
+	return created, fixed
+}
+
+func getCachedLintBaseline(
+	repository, commit string,
+	linter Linter,
+) ([]LintFinding, bool) {
+	value := cache.Get(
+		"lint-baseline", repository, commit,
+		linter.Name, linter.Dir, linter.Command,
+	)
+	if value == "" {
+		return nil, false
+	}
+
+	var findings []LintFinding
+	err := json.Unmarshal([]byte(value), &findings)
+	if err != nil {
+		return nil, false
+	}
+
+	return findings, true
+}
+
+func setCachedLintBaseline(
+	repository, commit string,
+	linter Linter,
+	findings []LintFinding,
+) {
+	value, err := json.Marshal(findings)
+	if err != nil {
+		return
+	}
+
+	cache.Set(
+		string(value), "lint-baseline", repository, commit,
+		linter.Name, linter.Dir, linter.Command,
+	)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	lintModeAll  = "all"
+	lintModeDiff = "diff"
+)
+
+var (
+	reDiffFile = regexp.MustCompile(`^\+\+\+ (?:b/)?(.*)$`)
+	reDiffHunk = regexp.MustCompile(
+		`^@@ -\d+(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`,
+	)
+)
+
+// lintDiff describes files and lines which are added or changed by the pull
+// request.
+type lintDiff struct {
+	files map[string]map[int]bool
+}
+
+// parseDiff parses output of git diff with zero context lines (-U0). Lines of
+// hunk are counted using line counts of hunk header, so added lines which
+// look like file headers are not confused with them.
+func parseDiff(output string) *lintDiff {
+	diff := &lintDiff{files: map[string]map[int]bool{}}
+
+	var (
+		lines   map[int]bool
+		removed int
+		added   int
+	)
+
+	for _, line := range strings.Split(output, "\n") {
+		if removed > 0 || added > 0 {
+			switch {
+			case strings.HasPrefix(line, "-"):
+				removed--
+			case strings.HasPrefix(line, "+"):
+				added--
+			case strings.HasPrefix(line, " "):
+				removed--
+				added--
+			}
+
+			continue
+		}
+
+		if matches := reDiffFile.FindStringSubmatch(line); matches != nil {
+			lines = nil
+			if matches[1] == "/dev/null" {
+				continue
+			}
+
+			lines = map[int]bool{}
+			diff.files[matches[1]] = lines
+			continue
+		}
+
+		matches := reDiffHunk.FindStringSubmatch(line)
+		if matches == nil {
+			continue
+		}
+
+		removed = getDiffHunkCount(matches[1])
+		added = getDiffHunkCount(matches[3])
+
+		if lines == nil {
+			continue
+		}
+
+		start, _ := strconv.Atoi(matches[2])
+		for number := start; number < start+added; number++ {
+			lines[number] = true
+		}
+	}
+
+	return diff
+}
+
+// getDiffHunkCount returns line count of hunk header, count is omitted if
+// it's 1.
+func getDiffHunkCount(value string) int {
+	if value == "" {
+		return 1
+	}
+
+	count, _ := strconv.Atoi(value)
+	return count
+}
+
+// IsChanged returns true if the finding points to the line changed by the
+// pull request, findings which point to the whole file are considered changed
+// if the file is changed, findings without position are always considered
+// changed because there is no way to tell where they are came from.
+func (diff *lintDiff) IsChanged(finding LintFinding) bool {
+	if finding.File == "" {
+		return true
+	}
+
+	lines, ok := diff.files[finding.File]
+	if !ok {
+		return false
+	}
+
+	return finding.Line == 0 || lines[finding.Line]
+}
+
+func (diff *lintDiff) IsAdded(file string, line int) bool {
+	return diff.files[file][line]
+}
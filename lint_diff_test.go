@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseDiff_AddedLinesLookingLikeHeaders(t *testing.T) {
+	diff := parseDiff(strings.Join([]string{
+		"diff --git a/main.go b/main.go",
+		"index 1111111..2222222 100644",
+		"--- a/main.go",
+		"+++ b/main.go",
+		"@@ -3,2 +3,3 @@ package main",
+		"--- a/removed",
+		"-old",
+		"+++ b",
+		"+@@ -1 +100,5 @@",
+		"+new",
+		"@@ -10,0 +12 @@ func main() {",
+		"+line",
+		"\\ No newline at end of file",
+		"diff --git a/old.go b/old.go",
+		"deleted file mode 100644",
+		"--- a/old.go",
+		"+++ /dev/null",
+		"@@ -1,2 +0,0 @@",
+		"-package main",
+		"-",
+		"diff --git a/new.go b/new.go",
+		"new file mode 100644",
+		"--- /dev/null",
+		"+++ b/new.go",
+		"@@ -0,0 +1,2 @@",
+		"+package main",
+		"++++ b/fake.go",
+	}, "\n"))
+
+	tests := []struct {
+		file     string
+		line     int
+		expected bool
+	}{
+		{"main.go", 2, false},
+		{"main.go", 3, true},
+		{"main.go", 4, true},
+		{"main.go", 5, true},
+		{"main.go", 6, false},
+		{"main.go", 12, true},
+		{"main.go", 100, false},
+		{"new.go", 1, true},
+		{"new.go", 2, true},
+		{"b", 1, false},
+		{"fake.go", 1, false},
+	}
+
+	for _, test := range tests {
+		if diff.IsAdded(test.file, test.line) != test.expected {
+			t.Errorf(
+				"%s:%d is added: %t, expected %t",
+				test.file, test.line, !test.expected, test.expected,
+			)
+		}
+	}
+
+	if len(diff.files) != 2 {
+		t.Errorf("diff has %d files, expected 2", len(diff.files))
+	}
+}
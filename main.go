@@ -1,6 +1,12 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/kovetskiy/godocs"
 	"github.com/kovetskiy/lorg"
 	"github.com/reconquest/colorgful"
@@ -14,6 +20,7 @@ var (
 
 Usage:
     uroboros [options]
+    uroboros [options] agent --server <url> [--name <name>] [--label <label>...]
 
 Options:
     -c --config <path>  Specify configuration file.
@@ -21,6 +28,15 @@ Options:
     --debug             Debug mode.
     --trace             Trace mode.
     -h --help           Show this help.
+
+Agent options:
+    agent               Run as build agent which takes tasks from the queue of
+                         the uroboros server, uses stash and linters settings
+                         and amount of threads from own configuration file.
+    --server <url>      Address of uroboros server.
+    --name <name>       Name of agent, hostname is used by default.
+    --label <label>     Label which is required by tasks, like go1.7 or docker,
+                         can be specified multiple times.
 `
 )
 
@@ -31,6 +47,11 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == sandboxHelperCommand {
+		runSandboxHelper(os.Args[2:])
+		return
+	}
+
 	args, err := godocs.Parse(usage, version, godocs.UsePager)
 	if err != nil {
 		fatalln(err)
@@ -53,7 +74,9 @@ func main() {
 		globalLogger.SetLevel(lorg.LevelTrace)
 	}
 
-	resources, err := GetResources(args["--config"].(string))
+	configPath := args["--config"].(string)
+
+	resources, err := GetResources(configPath)
 	if err != nil {
 		hierr.Fatalf(
 			err,
@@ -61,9 +84,18 @@ func main() {
 		)
 	}
 
+	if args["agent"].(bool) {
+		runAgent(args, resources)
+		return
+	}
+
+	go resources.agents.Watch()
+	go resources.branches.Watch()
+	go resources.schedules.Watch()
+
 	var (
 		scheduler = NewScheduler(getLogger("scheduler"), resources)
-		webserver = NewWebServer(getLogger("server"), resources)
+		webserver = NewWebServer(getLogger("server"), resources, scheduler)
 	)
 
 	scheduler.Schedule(resources.config.Tasks.Threads)
@@ -74,4 +106,141 @@ func main() {
 			"can't serve http connections",
 		)
 	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	for {
+		select {
+		case err := <-webserver.Errors():
+			hierr.Fatalf(
+				err,
+				"can't serve http connections",
+			)
+
+		case received := <-signals:
+			if received == syscall.SIGHUP {
+				resources = reload(configPath, resources, scheduler, webserver)
+				continue
+			}
+
+			shutdown(received, resources, scheduler, webserver)
+			return
+		}
+	}
+}
+
+func runAgent(args map[string]interface{}, resources *resources) {
+	name, _ := args["--name"].(string)
+	if name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hierr.Fatalf(
+				err,
+				"can't obtain hostname, specify agent name using --name",
+			)
+		}
+
+		name = hostname
+	}
+
+	labels, _ := args["--label"].([]string)
+
+	agent := NewAgentClient(
+		getLogger("agent"),
+		resources,
+		args["--server"].(string),
+		name,
+		labels,
+	)
+
+	err := agent.Run(resources.config.Tasks.Threads)
+	if err != nil {
+		hierr.Fatalf(
+			err,
+			"can't run agent",
+		)
+	}
+}
+
+func reload(
+	path string,
+	resources *resources,
+	scheduler *Scheduler,
+	webserver *WebServer,
+) *resources {
+	globalLogger.Infof("reloading configuration %s", path)
+
+	fresh, err := GetResources(path)
+	if err != nil {
+		globalLogger.Error(
+			hierr.Errorf(
+				err,
+				"can't reload configuration, keeping previous one",
+			),
+		)
+
+		return resources
+	}
+
+	if fresh.config.Web.Listen != webserver.GetAddress() {
+		err = webserver.Serve(fresh.config.Web.Listen)
+		if err != nil {
+			globalLogger.Error(
+				hierr.Errorf(
+					err,
+					"can't reload configuration, keeping previous one",
+				),
+			)
+
+			return resources
+		}
+	}
+
+	fresh.inherit(resources)
+
+	scheduler.SetResources(fresh)
+	webserver.SetResources(fresh)
+
+	scheduler.SetThreads(fresh.config.Tasks.Threads)
+
+	globalLogger.Infof("configuration reloaded")
+
+	return fresh
+}
+
+func shutdown(
+	received os.Signal,
+	resources *resources,
+	scheduler *Scheduler,
+	webserver *WebServer,
+) {
+	globalLogger.Infof(
+		"got %s, waiting %s for running tasks to finish",
+		received, resources.shutdownTimeout,
+	)
+
+	webserver.StopIntake()
+	scheduler.Drain()
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		resources.shutdownTimeout,
+	)
+	defer cancel()
+
+	if !scheduler.Wait(ctx) {
+		globalLogger.Warningf(
+			"running tasks are not finished in %s, exiting anyway",
+			resources.shutdownTimeout,
+		)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := webserver.Shutdown(ctx)
+	if err != nil {
+		globalLogger.Error(err)
+	}
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kovetskiy/stash"
+)
+
+const defaultApproveComment = "uroboros approve"
+
+// Policy describes which pull requests are built only after approval of a
+// maintainer, enabled policy requires approval of pull requests from forks,
+// pull requests to personal repositories and pull requests of authors which
+// are not listed in allow or maintainers:
+//
+//	[policy]
+//	  enabled = true
+//	  allow = ["john"]
+//	  maintainers = ["admin"]
+//	  approve_comment = "uroboros approve"
+//	  secrets = false
+//	  network = false
+//	  [policy.sandbox]
+//	    enabled = true
+//	    hidden = ["/home"]
+//
+// Maintainers approve builds by the comment in pull request, builds can be
+// also approved through API by admin. Approval is given for the head commit
+// of the pull request, which is built, new commits need new approval.
+// Approved builds are run with sandbox settings of the policy, without
+// secrets unless secrets is true and, if network is false, without network
+// in all steps after fetch, so dependencies still can be fetched.
+type Policy struct {
+	Enabled        bool
+	Allow          []string
+	Maintainers    []string
+	ApproveComment string `toml:"approve_comment"`
+	Secrets        bool
+	Network        *bool
+	Sandbox        SandboxOverride
+}
+
+// getApprovalReason returns reason why the build of the pull request should
+// be approved, returns empty string if the build doesn't need approval.
+func (resources *resources) getApprovalReason(
+	task *TaskStashPullRequest,
+	pullRequest stash.PullRequest,
+) string {
+	policy := resources.config.Policy
+	if !policy.Enabled {
+		return ""
+	}
+
+	var (
+		from = pullRequest.FromRef.Repository
+		to   = pullRequest.ToRef.Repository
+	)
+
+	if !strings.EqualFold(from.Project.Key, to.Project.Key) ||
+		from.Slug != to.Slug {
+		return fmt.Sprintf(
+			"pull request is opened from fork %s/%s",
+			from.Project.Key, from.Slug,
+		)
+	}
+
+	if strings.HasPrefix(to.Project.Key, "~") ||
+		strings.Contains(task.URL, "/users/") {
+		return "pull request is opened in personal repository"
+	}
+
+	author := pullRequest.Author.User.Name
+	if !policy.isTrusted(author) {
+		return fmt.Sprintf("author %s is not allowed", author)
+	}
+
+	return ""
+}
+
+// isTrusted returns true if user is listed in allow or maintainers.
+func (policy Policy) isTrusted(user string) bool {
+	return policy.isMaintainer(user) || containsString(policy.Allow, user)
+}
+
+func (policy Policy) isMaintainer(user string) bool {
+	return containsString(policy.Maintainers, user)
+}
+
+func (policy Policy) getApproveComment() string {
+	if policy.ApproveComment == "" {
+		return defaultApproveComment
+	}
+
+	return policy.ApproveComment
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
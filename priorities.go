@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"path"
+)
+
+// Triggers of tasks which are used to choose default priority of tasks
+// queued without explicit priority.
+const (
+	triggerManual   = "manual"
+	triggerRebuild  = "rebuild"
+	triggerPush     = "push"
+	triggerSchedule = "schedule"
+)
+
+// Priorities configures default priorities of tasks which are queued without
+// explicit priority, rebuild is a manual build of already built branch or
+// pull request:
+//
+//	[tasks.priorities]
+//	  manual = "normal"
+//	  rebuild = "high"
+//	  push = "normal"
+//	  schedule = "low"
+//	  [tasks.priorities.branches]
+//	    "release/*" = "high"
+//
+// Branch patterns are matched against branch of branch builds, the highest
+// of trigger and branch priorities is used.
+type Priorities struct {
+	Manual   string
+	Rebuild  string
+	Push     string
+	Schedule string
+	Branches map[string]string
+}
+
+type priorities struct {
+	triggers map[string]TaskPriority
+	branches map[string]TaskPriority
+}
+
+func parsePriorities(config Priorities) (priorities, error) {
+	result := priorities{
+		triggers: map[string]TaskPriority{},
+		branches: map[string]TaskPriority{},
+	}
+
+	for _, trigger := range []struct {
+		name     string
+		value    string
+		fallback TaskPriority
+	}{
+		{triggerManual, config.Manual, TaskPriorityNormal},
+		{triggerRebuild, config.Rebuild, TaskPriorityHigh},
+		{triggerPush, config.Push, TaskPriorityNormal},
+		{triggerSchedule, config.Schedule, TaskPriorityNormal},
+	} {
+		if trigger.value == "" {
+			result.triggers[trigger.name] = trigger.fallback
+			continue
+		}
+
+		priority, err := ParseTaskPriority(trigger.value)
+		if err != nil {
+			return result, fmt.Errorf(
+				"invalid priority of %s: %s", trigger.name, err,
+			)
+		}
+
+		result.triggers[trigger.name] = priority
+	}
+
+	for pattern, value := range config.Branches {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return result, fmt.Errorf(
+				"invalid branch pattern '%s': %s", pattern, err,
+			)
+		}
+
+		priority, err := ParseTaskPriority(value)
+		if err != nil {
+			return result, fmt.Errorf(
+				"invalid priority of branches '%s': %s", pattern, err,
+			)
+		}
+
+		result.branches[pattern] = priority
+	}
+
+	return result, nil
+}
+
+// get returns default priority of the task queued by the given trigger.
+func (priorities priorities) get(task Task, trigger string) TaskPriority {
+	priority, ok := priorities.triggers[trigger]
+	if !ok {
+		priority = TaskPriorityNormal
+	}
+
+	branch, ok := task.(*TaskStashBranch)
+	if !ok {
+		return priority
+	}
+
+	for pattern, value := range priorities.branches {
+		matched, _ := path.Match(pattern, branch.Branch)
+		if matched && value > priority {
+			priority = value
+		}
+	}
+
+	return priority
+}
@@ -22,6 +22,9 @@ func NewProcessor(task Task) Processor {
 	switch target := task.(type) {
 	case *TaskStashPullRequest:
 		return NewProcessorStashPullRequest(target)
+
+	case *TaskStashBranch:
+		return NewProcessorStashBranch(target)
 	}
 
 	panic("unexpected task")
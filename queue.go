@@ -1,55 +1,195 @@
 package main
 
 import (
+	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/kovetskiy/lorg"
 )
 
 type Queue struct {
-	channel chan Task
-	queued  int64
-	poped   int64
-	logger  *lorg.Log
-	tasks   []Task
-	mutex   *sync.Mutex
+	queued     int64
+	poped      int64
+	logger     *lorg.Log
+	tasks      []Task
+	pending    []Task
+	running    []Task
+	waiting    []Task
+	limiter    *limiter
+	priorities priorities
+	mutex      *sync.Mutex
+	cond       *sync.Cond
 }
 
 func NewQueue(logger *lorg.Log) *Queue {
 	queue := &Queue{
-		channel: make(chan Task),
 		logger:  logger,
+		limiter: newLimiter(),
 		mutex:   &sync.Mutex{},
 	}
 
+	queue.cond = sync.NewCond(queue.mutex)
+
 	return queue
 }
 
 func (queue *Queue) Push(task Task) int64 {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	return queue.push(task)
+}
+
+// PushOnce pushes the task unless task with the same identifier is already
+// pending, returns unique id of the pending task and false in that case.
+func (queue *Queue) PushOnce(task Task) (int64, bool) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	for _, pending := range queue.pending {
+		if pending.GetIdentifier() == task.GetIdentifier() {
+			return pending.GetUniqueID(), false
+		}
+	}
+
+	return queue.push(task), true
+}
+
+func (queue *Queue) push(task Task) int64 {
 	uniqueID := atomic.AddInt64(&queue.queued, 1)
 
 	task.SetUniqueID(uniqueID)
 	task.SetState(TaskStateQueued)
 
-	queue.mutex.Lock()
 	queue.tasks = append(queue.tasks, task)
-	queue.mutex.Unlock()
-
-	go func() {
-		queue.channel <- task
-	}()
+	queue.insert(task)
 
 	queue.logger.Debugf(
-		"[%d/%d] push #%d",
-		queue.poped, queue.queued, task.GetUniqueID(),
+		"[%d/%d] push #%d with %s priority",
+		queue.poped, queue.queued, task.GetUniqueID(), task.GetPriority(),
 	)
 
+	queue.cond.Signal()
+
 	return uniqueID
 }
 
-func (queue *Queue) Pop() Task {
-	task := <-queue.channel
+func (queue *Queue) SetLimits(limits Limits) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.limiter.limits = limits
+
+	queue.cond.Broadcast()
+}
+
+func (queue *Queue) SetPriorities(priorities priorities) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.priorities = priorities
+}
+
+// GetDefaultPriority returns priority of the task which is queued by the
+// given trigger without explicit priority, manual build of already queued
+// branch or pull request is considered a rebuild.
+func (queue *Queue) GetDefaultPriority(task Task, trigger string) TaskPriority {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if trigger == triggerManual {
+		for _, queued := range queue.tasks {
+			if queued.GetIdentifier() == task.GetIdentifier() {
+				trigger = triggerRebuild
+				break
+			}
+		}
+	}
+
+	return queue.priorities.get(task, trigger)
+}
+
+// Pop returns the first pending task which doesn't exceed concurrency limits
+// and doesn't require labels missing in given labels, tasks which can't be
+// started right now are skipped and keep their places.
+// Every popped task should be released using Done after processing.
+// Pop returns nil if interrupted returns true, the callback is checked on
+// every wake up, see Wake.
+func (queue *Queue) Pop(labels []string, interrupted func() bool) Task {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	var index int
+	for {
+		if interrupted() {
+			return nil
+		}
+
+		index = queue.indexAvailable(labels)
+		if index >= 0 {
+			break
+		}
+
+		queue.cond.Wait()
+	}
+
+	return queue.take(index)
+}
+
+// TryPop is the same as Pop, but returns nil instead of waiting for available
+// task.
+func (queue *Queue) TryPop(labels []string) Task {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	index := queue.indexAvailable(labels)
+	if index < 0 {
+		return nil
+	}
+
+	return queue.take(index)
+}
+
+// Requeue returns running task back to the queue, task keeps its place
+// according to priority and unique id.
+func (queue *Queue) Requeue(task Task) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if !queue.release(task) {
+		return
+	}
+
+	if task.GetContext().Err() != nil {
+		task.SetState(TaskStateCancelled)
+		task.SetFinishedAt(time.Now())
+
+		queue.logger.Debugf("#%d is cancelled, not requeued", task.GetUniqueID())
+
+		queue.cond.Broadcast()
+
+		return
+	}
+
+	task.SetState(TaskStateQueued)
+	task.SetStartedAt(time.Time{})
+
+	queue.insert(task)
+
+	queue.logger.Debugf("requeue #%d", task.GetUniqueID())
+
+	queue.cond.Broadcast()
+}
+
+func (queue *Queue) take(index int) Task {
+	task := queue.pending[index]
+	queue.pending = append(queue.pending[:index], queue.pending[index+1:]...)
+	queue.running = append(queue.running, task)
+
+	task.SetStartedAt(time.Now())
+
 	atomic.AddInt64(&queue.poped, 1)
 
 	queue.logger.Debugf(
@@ -60,7 +200,219 @@ func (queue *Queue) Pop() Task {
 	return task
 }
 
+// Wake wakes up all callers blocked in Pop, so they can check whether they
+// were interrupted.
+func (queue *Queue) Wake() {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.cond.Broadcast()
+}
+
+// Done releases processed task, task which is awaiting approval is kept
+// until it's approved, see Approve. Previous approval of such task is
+// revoked, because it's given for another commit.
+func (queue *Queue) Done(task Task) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if queue.release(task) && task.GetState() == TaskStateAwaitingApproval {
+		task.SetStartedAt(time.Time{})
+		task.SetApproved(false)
+
+		queue.waiting = append(queue.waiting, task)
+
+		queue.logger.Debugf("#%d is awaiting approval", task.GetUniqueID())
+	}
+
+	queue.cond.Broadcast()
+}
+
+// Approve returns task which is awaiting approval back to the queue, task
+// keeps its place according to priority and unique id.
+func (queue *Queue) Approve(task Task) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	for i, waiting := range queue.waiting {
+		if waiting != task {
+			continue
+		}
+
+		queue.waiting = append(queue.waiting[:i], queue.waiting[i+1:]...)
+
+		task.SetApproved(true)
+		task.SetState(TaskStateQueued)
+
+		queue.insert(task)
+
+		queue.logger.Debugf("approved #%d", task.GetUniqueID())
+
+		queue.cond.Signal()
+
+		return nil
+	}
+
+	return fmt.Errorf(
+		"task #%d is not awaiting approval, it is %s",
+		task.GetUniqueID(), task.GetState(),
+	)
+}
+
+// Cancel cancels the task, queued task and task which is awaiting approval
+// are removed from the queue, running task is interrupted and its state is
+// set by the processor.
+func (queue *Queue) Cancel(task Task) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	for _, running := range queue.running {
+		if running == task {
+			task.Cancel()
+
+			queue.logger.Debugf("cancelling running #%d", task.GetUniqueID())
+
+			return nil
+		}
+	}
+
+	if index := queue.indexPending(task); index >= 0 {
+		queue.pending = append(queue.pending[:index], queue.pending[index+1:]...)
+	} else if index := queue.indexWaiting(task); index >= 0 {
+		queue.waiting = append(queue.waiting[:index], queue.waiting[index+1:]...)
+	} else {
+		return fmt.Errorf(
+			"task #%d is not queued or running, it is %s",
+			task.GetUniqueID(), task.GetState(),
+		)
+	}
+
+	task.Cancel()
+	task.SetState(TaskStateCancelled)
+	task.SetFinishedAt(time.Now())
+
+	queue.logger.Debugf("cancelled #%d", task.GetUniqueID())
+
+	return nil
+}
+
+// release removes task from list of running tasks and releases its
+// concurrency limits, returns false if the task is not running.
+func (queue *Queue) release(task Task) bool {
+	for i, running := range queue.running {
+		if running == task {
+			queue.running = append(queue.running[:i], queue.running[i+1:]...)
+			queue.limiter.release(task)
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetPriority changes priority of the task which is still waiting in the
+// queue and moves it to its new priority level.
+func (queue *Queue) SetPriority(task Task, priority TaskPriority) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	index := queue.indexPending(task)
+	if index < 0 {
+		return fmt.Errorf(
+			"task #%d is not queued, it is %s",
+			task.GetUniqueID(), task.GetState(),
+		)
+	}
+
+	queue.pending = append(queue.pending[:index], queue.pending[index+1:]...)
+
+	task.SetPriority(priority)
+
+	queue.insert(task)
+
+	queue.logger.Debugf(
+		"changed priority of #%d to %s",
+		task.GetUniqueID(), priority,
+	)
+
+	return nil
+}
+
+// insert places task after all pending tasks with higher priority, tasks of
+// one priority level are served in order of arrival.
+func (queue *Queue) insert(task Task) {
+	index := len(queue.pending)
+	for i, pending := range queue.pending {
+		if pending.GetPriority() < task.GetPriority() ||
+			(pending.GetPriority() == task.GetPriority() &&
+				pending.GetUniqueID() > task.GetUniqueID()) {
+			index = i
+			break
+		}
+	}
+
+	queue.pending = append(queue.pending, nil)
+	copy(queue.pending[index+1:], queue.pending[index:])
+	queue.pending[index] = task
+}
+
+func (queue *Queue) indexAvailable(labels []string) int {
+	for i, pending := range queue.pending {
+		if !hasLabels(labels, pending.GetLabels()) {
+			continue
+		}
+
+		if queue.limiter.acquire(pending) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func hasLabels(labels []string, required []string) bool {
+	for _, label := range required {
+		found := false
+		for _, given := range labels {
+			if given == label {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (queue *Queue) indexPending(task Task) int {
+	for i, pending := range queue.pending {
+		if pending == task {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (queue *Queue) indexWaiting(task Task) int {
+	for i, waiting := range queue.waiting {
+		if waiting == task {
+			return i
+		}
+	}
+
+	return -1
+}
+
 func (queue *Queue) GetTaskByIdentifier(identifier string) Task {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
 	for i := len(queue.tasks) - 1; i >= 0; i-- {
 		if queue.tasks[i].GetIdentifier() == identifier {
 			return queue.tasks[i]
@@ -70,10 +422,70 @@ func (queue *Queue) GetTaskByIdentifier(identifier string) Task {
 	return nil
 }
 
+// GetLatestFinishedTaskByIdentifier returns the latest task with the given
+// identifier which is finished, cancelled tasks are skipped, because they
+// say nothing about the build.
+func (queue *Queue) GetLatestFinishedTaskByIdentifier(identifier string) Task {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	for i := len(queue.tasks) - 1; i >= 0; i-- {
+		task := queue.tasks[i]
+		if task.GetIdentifier() != identifier {
+			continue
+		}
+
+		if task.GetState().IsFinished() &&
+			task.GetState() != TaskStateCancelled {
+			return task
+		}
+	}
+
+	return nil
+}
+
 func (queue *Queue) GetTaskByUniqueID(id int) Task {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
 	if id <= len(queue.tasks) && id >= 1 {
 		return queue.tasks[id-1]
 	}
 
 	return nil
 }
+
+// GetAwaitingTasks returns tasks which are awaiting approval.
+func (queue *Queue) GetAwaitingTasks() []Task {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	tasks := make([]Task, len(queue.waiting))
+	copy(tasks, queue.waiting)
+
+	return tasks
+}
+
+func (queue *Queue) GetPendingCount() int {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	return len(queue.pending)
+}
+
+func (queue *Queue) GetRunningCount() int {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	return len(queue.running)
+}
+
+func (queue *Queue) GetTasks() []Task {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	tasks := make([]Task, len(queue.tasks))
+	copy(tasks, queue.tasks)
+
+	return tasks
+}
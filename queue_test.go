@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/kovetskiy/lorg"
+)
+
+func TestQueue_LatestFinishedTaskSkipsOnlyCancelled(t *testing.T) {
+	const url = "http://git.local/projects/prj/repos/repo/browse?at=master"
+
+	queue := NewQueue(lorg.NewLog())
+
+	states := []TaskState{
+		TaskStateSuccess,
+		TaskStateTimedOut,
+		TaskStateCancelled,
+		TaskStateQueued,
+	}
+
+	tasks := []Task{}
+	for _, state := range states {
+		task, err := NewTaskFromURL(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		queue.Push(task)
+		task.SetState(state)
+
+		tasks = append(tasks, task)
+	}
+
+	latest := queue.GetLatestFinishedTaskByIdentifier(tasks[0].GetIdentifier())
+	if latest != tasks[1] {
+		t.Fatalf(
+			"latest finished task is %v, expected timed out task",
+			latest,
+		)
+	}
+
+	tasks[1].SetState(TaskStateError)
+
+	latest = queue.GetLatestFinishedTaskByIdentifier(tasks[0].GetIdentifier())
+	if latest != tasks[1] {
+		t.Fatalf("latest finished task is %v, expected failed task", latest)
+	}
+}
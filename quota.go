@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/reconquest/hierr-go"
+)
+
+const quotaDiskInterval = 5 * time.Second
+
+// Reasons why the build command is killed.
+const (
+	quotaKilledMemory = "memory limit exceeded"
+	quotaKilledDisk   = "disk quota exceeded"
+)
+
+// Quota caps resources which can be used by build commands of the single
+// task, memory, cpu and processes limits are applied through cgroups v2, so
+// cgroup should be a directory of cgroup delegated to uroboros user which
+// doesn't contain processes, required controllers are enabled in it by
+// uroboros:
+//
+//	[tasks.quota]
+//	  cgroup = "/sys/fs/cgroup/uroboros"
+//	  memory = "4G"
+//	  cpu = 2.0
+//	  processes = 1024
+//	  disk = "10G"
+//
+// Disk limits size of the task workspace, which includes sources,
+// dependencies and HOME of build commands, together with growth of the build
+// cache of the repository. Zero or empty value means no limit.
+type Quota struct {
+	Cgroup    string
+	Memory    string
+	CPU       float64 `toml:"cpu"`
+	Processes int
+	Disk      string
+}
+
+type quota struct {
+	cgroup    string
+	memory    int64
+	cpu       float64
+	processes int
+	disk      int64
+}
+
+// ResourceUsage is a peak usage of resources by build commands of the task.
+type ResourceUsage struct {
+	Memory  int64   `json:"memory"`
+	CPUTime float64 `json:"cpu_time"`
+	Disk    int64   `json:"disk"`
+	Killed  string  `json:"killed,omitempty"`
+}
+
+func (usage ResourceUsage) String() string {
+	result := fmt.Sprintf(
+		"memory %s, cpu %.1fs, disk %s",
+		formatSize(usage.Memory), usage.CPUTime, formatSize(usage.Disk),
+	)
+
+	if usage.Killed != "" {
+		result += ", killed: " + usage.Killed
+	}
+
+	return result
+}
+
+func parseQuota(config Quota) (quota, error) {
+	var (
+		result = quota{
+			cgroup:    config.Cgroup,
+			cpu:       config.CPU,
+			processes: config.Processes,
+		}
+		err error
+	)
+
+	if config.Memory != "" {
+		result.memory, err = parseSize(config.Memory)
+		if err != nil {
+			return result, hierr.Errorf(err, "can't parse memory")
+		}
+	}
+
+	if config.Disk != "" {
+		result.disk, err = parseSize(config.Disk)
+		if err != nil {
+			return result, hierr.Errorf(err, "can't parse disk")
+		}
+	}
+
+	if result.cpu < 0 || result.processes < 0 {
+		return result, fmt.Errorf("cpu and processes can't be negative")
+	}
+
+	if result.cgroup == "" &&
+		(result.memory > 0 || result.cpu > 0 || result.processes > 0) {
+		return result, fmt.Errorf(
+			"cgroup should be set to limit memory, cpu or processes",
+		)
+	}
+
+	return result, nil
+}
+
+// parseSize parses size like 512M or 10G, suffixes are powers of 1024.
+func parseSize(value string) (int64, error) {
+	var (
+		number     = strings.TrimSuffix(strings.ToUpper(value), "B")
+		multiplier = int64(1)
+	)
+
+	for _, unit := range []string{"K", "M", "G", "T"} {
+		multiplier *= 1024
+
+		if strings.HasSuffix(number, unit) {
+			size, err := strconv.ParseInt(strings.TrimSuffix(number, unit), 10, 64)
+			if err != nil || size < 0 {
+				return 0, fmt.Errorf("invalid size '%s'", value)
+			}
+
+			return size * multiplier, nil
+		}
+	}
+
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", value)
+	}
+
+	return size, nil
+}
+
+func formatSize(size int64) string {
+	value := float64(size)
+	for _, unit := range []string{"B", "KiB", "MiB", "GiB"} {
+		if value < 1024 {
+			return fmt.Sprintf("%.1f%s", value, unit)
+		}
+
+		value /= 1024
+	}
+
+	return fmt.Sprintf("%.1fTiB", value)
+}
+
+// taskQuota applies quota to build commands of the task and tracks their
+// resource usage, commands of the task share the same cgroup, so limits are
+// applied to the whole task.
+type taskQuota struct {
+	quota  quota
+	cgroup string
+	fd     *os.File
+	usage  ResourceUsage
+
+	// oomKills is a last seen amount of processes which were killed in the
+	// cgroup because of memory limit.
+	oomKills int64
+
+	// cache is a build cache which is shared with other tasks of the
+	// repository, only its growth since cacheSize is counted.
+	cache     string
+	cacheSize int64
+
+	mutex *sync.Mutex
+}
+
+// newTaskQuota creates cgroup of the task if memory, cpu or processes are
+// limited.
+func (resources *resources) newTaskQuota(task Task) (*taskQuota, error) {
+	limits := &taskQuota{
+		quota: resources.quota,
+		mutex: &sync.Mutex{},
+	}
+
+	if limits.quota.cgroup == "" {
+		return limits, nil
+	}
+
+	err := limits.quota.enableControllers()
+	if err != nil {
+		return nil, err
+	}
+
+	limits.cgroup = filepath.Join(
+		limits.quota.cgroup,
+		fmt.Sprintf("task-%d-%d", os.Getpid(), task.GetUniqueID()),
+	)
+
+	err = os.Mkdir(limits.cgroup, 0755)
+	if err != nil {
+		return nil, hierr.Errorf(err, "can't create cgroup %s", limits.cgroup)
+	}
+
+	controls := map[string]string{}
+
+	if limits.quota.memory > 0 {
+		controls["memory.max"] = strconv.FormatInt(limits.quota.memory, 10)
+		controls["memory.swap.max"] = "0"
+
+		// whole command is killed instead of single process, so runaway
+		// test doesn't leave half-dead command.
+		controls["memory.oom.group"] = "1"
+	}
+
+	if limits.quota.cpu > 0 {
+		controls["cpu.max"] = fmt.Sprintf(
+			"%d 100000", int64(limits.quota.cpu*100000),
+		)
+	}
+
+	if limits.quota.processes > 0 {
+		controls["pids.max"] = strconv.Itoa(limits.quota.processes)
+	}
+
+	for name, value := range controls {
+		err = ioutil.WriteFile(
+			filepath.Join(limits.cgroup, name), []byte(value), 0644,
+		)
+		if err != nil && !(name == "memory.swap.max" && os.IsNotExist(err)) {
+			limits.release("")
+			return nil, hierr.Errorf(
+				err, "can't set %s of cgroup, is controller enabled?", name,
+			)
+		}
+	}
+
+	limits.fd, err = os.Open(limits.cgroup)
+	if err != nil {
+		limits.release("")
+		return nil, hierr.Errorf(err, "can't open cgroup %s", limits.cgroup)
+	}
+
+	return limits, nil
+}
+
+// enableControllers enables controllers which are required by limits for
+// children of the quota cgroup, otherwise limits can't be set.
+func (quota quota) enableControllers() error {
+	controllers := []string{}
+
+	if quota.memory > 0 {
+		controllers = append(controllers, "+memory")
+	}
+
+	if quota.cpu > 0 {
+		controllers = append(controllers, "+cpu")
+	}
+
+	if quota.processes > 0 {
+		controllers = append(controllers, "+pids")
+	}
+
+	if len(controllers) == 0 {
+		return nil
+	}
+
+	err := ioutil.WriteFile(
+		filepath.Join(quota.cgroup, "cgroup.subtree_control"),
+		[]byte(strings.Join(controllers, " ")),
+		0644,
+	)
+	if err != nil {
+		return hierr.Errorf(
+			err,
+			"can't enable controllers %s in cgroup %s, it should be "+
+				"cgroup v2 delegated to uroboros user without processes",
+			strings.Join(controllers, " "), quota.cgroup,
+		)
+	}
+
+	return nil
+}
+
+// run executes the command with the quota applied, returns error which says
+// why the command is killed if it exceeded the quota.
+func (limits *taskQuota) run(
+	cmd *exec.Cmd,
+	workspace string,
+	cancel context.CancelFunc,
+	execute func(*exec.Cmd) ([]byte, []byte, error),
+) ([]byte, []byte, error) {
+	if limits.fd != nil {
+		err := cgroupCommand(cmd, limits.fd)
+		if err != nil {
+			return nil, nil, hierr.Errorf(err, "can't apply quota to command")
+		}
+	}
+
+	groupCommand(cmd)
+
+	var (
+		done     = make(chan struct{})
+		exceeded = make(chan bool, 1)
+	)
+
+	if workspace != "" {
+		go limits.watchDisk(workspace, cancel, done, exceeded)
+	} else {
+		exceeded <- false
+	}
+
+	stdout, stderr, err := execute(cmd)
+
+	close(done)
+
+	killed := <-exceeded
+
+	limits.mutex.Lock()
+	defer limits.mutex.Unlock()
+
+	if cmd.ProcessState != nil {
+		if memory := getMaxRSS(cmd.ProcessState); memory > limits.usage.Memory {
+			limits.usage.Memory = memory
+		}
+
+		limits.usage.CPUTime += (cmd.ProcessState.UserTime() +
+			cmd.ProcessState.SystemTime()).Seconds()
+	}
+
+	if killed {
+		limits.usage.Killed = quotaKilledDisk
+
+		return stdout, stderr, fmt.Errorf(
+			"killed: %s (%s)", quotaKilledDisk, formatSize(limits.quota.disk),
+		)
+	}
+
+	if err != nil && limits.cgroup != "" && limits.quota.memory > 0 {
+		kills, _ := limits.readCgroupValue("memory.events", "oom_kill")
+		if kills > limits.oomKills {
+			limits.oomKills = kills
+			limits.usage.Killed = quotaKilledMemory
+
+			return stdout, stderr, fmt.Errorf(
+				"killed: %s (%s)",
+				quotaKilledMemory, formatSize(limits.quota.memory),
+			)
+		}
+	}
+
+	return stdout, stderr, err
+}
+
+// watchDisk periodically measures size of the workspace until done is
+// closed, cancels the command if the size exceeds disk quota.
+func (limits *taskQuota) watchDisk(
+	workspace string,
+	cancel context.CancelFunc,
+	done <-chan struct{},
+	exceeded chan<- bool,
+) {
+	ticker := time.NewTicker(quotaDiskInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			exceeded <- false
+			return
+
+		case <-ticker.C:
+		}
+
+		size := limits.measureDisk(workspace)
+		if limits.quota.disk > 0 && size > limits.quota.disk {
+			limits.kill()
+			cancel()
+			exceeded <- true
+			return
+		}
+	}
+}
+
+// kill kills all processes in cgroup of the task, so processes which are
+// started by commands in background are killed too. Commands without cgroup
+// or on kernels without cgroup.kill are killed as process group on cancel.
+func (limits *taskQuota) kill() {
+	if limits.cgroup == "" {
+		return
+	}
+
+	ioutil.WriteFile(
+		filepath.Join(limits.cgroup, "cgroup.kill"), []byte("1"), 0644,
+	)
+}
+
+// watchCache makes growth of the given build cache counted as disk usage of
+// the task.
+func (limits *taskQuota) watchCache(cache string) {
+	size := getDirectorySize(cache)
+
+	limits.mutex.Lock()
+	limits.cache = cache
+	limits.cacheSize = size
+	limits.mutex.Unlock()
+}
+
+// measureDisk returns size of the workspace with growth of the build cache
+// and records it as peak disk usage if it's the largest one.
+func (limits *taskQuota) measureDisk(workspace string) int64 {
+	size := getDirectorySize(workspace)
+
+	limits.mutex.Lock()
+	cache, cacheSize := limits.cache, limits.cacheSize
+	limits.mutex.Unlock()
+
+	if cache != "" {
+		if growth := getDirectorySize(cache) - cacheSize; growth > 0 {
+			size += growth
+		}
+	}
+
+	limits.mutex.Lock()
+	if size > limits.usage.Disk {
+		limits.usage.Disk = size
+	}
+	limits.mutex.Unlock()
+
+	return size
+}
+
+// release records peak usage of resources and removes cgroup of the task,
+// workspace should be measured before it's removed.
+func (limits *taskQuota) release(workspace string) ResourceUsage {
+	if workspace != "" {
+		limits.measureDisk(workspace)
+	}
+
+	limits.mutex.Lock()
+	defer limits.mutex.Unlock()
+
+	if limits.cgroup == "" {
+		return limits.usage
+	}
+
+	peak, err := limits.readCgroupValue("memory.peak", "")
+	if err == nil && peak > limits.usage.Memory {
+		limits.usage.Memory = peak
+	}
+
+	usec, err := limits.readCgroupValue("cpu.stat", "usage_usec")
+	if err == nil {
+		limits.usage.CPUTime = float64(usec) / 1e6
+	}
+
+	if limits.fd != nil {
+		limits.fd.Close()
+	}
+
+	// cgroup can't be removed while killed processes are exiting.
+	for attempt := 0; attempt < 10; attempt++ {
+		err = os.Remove(limits.cgroup)
+		if err == nil || os.IsNotExist(err) {
+			break
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return limits.usage
+}
+
+// readCgroupValue reads value of the cgroup file, key is a name of the value
+// in flat keyed files like memory.events, it's empty for single value files.
+func (limits *taskQuota) readCgroupValue(name, key string) (int64, error) {
+	file, err := os.Open(filepath.Join(limits.cgroup, name))
+	if err != nil {
+		return 0, err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		switch {
+		case key == "" && len(fields) == 1:
+			return strconv.ParseInt(fields[0], 10, 64)
+
+		case len(fields) == 2 && fields[0] == key:
+			return strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, fmt.Errorf("no %s in %s", key, name)
+}
+
+// getDirectorySize returns size of files in the directory, sandbox root of
+// the workspace is skipped, because it has only mount points.
+func getDirectorySize(path string) int64 {
+	var (
+		size    int64
+		sandbox = filepath.Join(path, ".sandbox")
+	)
+
+	filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if info.IsDir() && name == sandbox {
+			return filepath.SkipDir
+		}
+
+		if !info.IsDir() {
+			size += info.Size()
+		}
+
+		return nil
+	})
+
+	return size
+}
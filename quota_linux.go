@@ -0,0 +1,49 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// cgroupCommand makes the command start in the given cgroup, so there is no
+// moment when the command is running without limits.
+func cgroupCommand(cmd *exec.Cmd, cgroup *os.File) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(cgroup.Fd())
+
+	return nil
+}
+
+// groupCommand makes the command start in its own process group, which is
+// killed entirely when context of the command is done, so children of the
+// command don't outlive it.
+func groupCommand(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	cmd.SysProcAttr.Setpgid = true
+
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// getMaxRSS returns maximum resident set size of the process and its waited
+// children in bytes.
+func getMaxRSS(state *os.ProcessState) int64 {
+	rusage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0
+	}
+
+	return rusage.Maxrss * 1024
+}
@@ -0,0 +1,70 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTaskQuota_KillsBackgroundProcessesOnCancel(t *testing.T) {
+	limits := &taskQuota{mutex: &sync.Mutex{}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(
+		ctx, "sh", "-c", "sleep 60 & echo $!; wait",
+	)
+
+	var pid int
+
+	_, _, err := limits.run(
+		cmd, "", cancel,
+		func(cmd *exec.Cmd) ([]byte, []byte, error) {
+			stdout, err := cmd.StdoutPipe()
+			if err != nil {
+				return nil, nil, err
+			}
+
+			err = cmd.Start()
+			if err != nil {
+				return nil, nil, err
+			}
+
+			buffer := make([]byte, 32)
+			size, _ := stdout.Read(buffer)
+
+			pid, _ = strconv.Atoi(strings.TrimSpace(string(buffer[:size])))
+
+			return buffer[:size], nil, cmd.Wait()
+		},
+	)
+	if err == nil {
+		t.Fatal("command is not killed")
+	}
+
+	if pid == 0 {
+		t.Fatal("pid of background process is not printed")
+	}
+
+	// killed process is reaped by init, so it can be seen for a while.
+	for attempt := 0; attempt < 50; attempt++ {
+		if syscall.Kill(pid, 0) != nil {
+			return
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	syscall.Kill(pid, syscall.SIGKILL)
+
+	t.Fatalf("background process %d is still running", pid)
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+func cgroupCommand(cmd *exec.Cmd, cgroup *os.File) error {
+	return errors.New("cgroups are supported only on linux")
+}
+
+func groupCommand(cmd *exec.Cmd) {
+}
+
+func getMaxRSS(state *os.ProcessState) int64 {
+	return 0
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, path string, size int) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(path, make([]byte, size), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTaskQuota_MeasuresWorkspaceAndCacheGrowth(t *testing.T) {
+	var (
+		gopath = t.TempDir()
+		cache  = t.TempDir()
+		limits = &taskQuota{mutex: &sync.Mutex{}}
+	)
+
+	writeTestFile(t, filepath.Join(cache, "previous"), 1000)
+
+	limits.watchCache(cache)
+
+	writeTestFile(t, filepath.Join(gopath, "src", "repo", "main.go"), 10)
+	writeTestFile(t, filepath.Join(gopath, "pkg", "mod", "dependency"), 20)
+	writeTestFile(t, filepath.Join(gopath, ".home", "junk"), 30)
+	writeTestFile(t, filepath.Join(gopath, ".sandbox", "mount"), 40)
+	writeTestFile(t, filepath.Join(cache, "built"), 50)
+
+	size := limits.measureDisk(gopath)
+	if size != 110 {
+		t.Fatalf("measured %d bytes, expected 110", size)
+	}
+
+	if usage := limits.release(gopath); usage.Disk != 110 {
+		t.Fatalf("peak disk usage is %d bytes, expected 110", usage.Disk)
+	}
+}
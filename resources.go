@@ -1,40 +1,111 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/url"
+	"runtime"
+	"time"
 
 	"github.com/kovetskiy/ko"
 	"github.com/kovetskiy/stash"
 	"github.com/reconquest/hierr-go"
 )
 
+const defaultShutdownTimeout = 10 * time.Minute
+
 type config struct {
 	Web struct {
-		Listen   string `required:"true"`
-		BasicURL string `toml:"basic_url" required:"true"`
+		Listen     string `required:"true"`
+		BasicURL   string `toml:"basic_url" required:"true"`
+		AdminToken string `toml:"admin_token"`
 	} `toml:"web" required:"true"`
 
+	Auth Auth
+
 	Tasks struct {
-		Threads int `required:"true"`
+		Threads         int    `required:"true"`
+		ShutdownTimeout string `toml:"shutdown_timeout"`
+		Timeout         string
+		Labels          []string
+		Limits          Limits
+		Priorities      Priorities
+		Quota           Quota
 	} `required:"true"`
 
+	Agents struct {
+		Token        string
+		LeaseTimeout string `toml:"lease_timeout"`
+	}
+
+	Branches struct {
+		Watch        []string
+		PollInterval string `toml:"poll_interval"`
+		WebhookToken string `toml:"webhook_token"`
+	}
+
+	Schedules []Schedule
+
+	Steps map[string]Step
+
+	Environment Environment
+
+	Secrets struct {
+		File      string
+		Variables []Secret
+	}
+
+	Policy Policy
+
+	Sandbox struct {
+		Enabled      bool
+		Writable     []string
+		Hidden       []string
+		Repositories map[string]SandboxOverride
+	}
+
 	Resources struct {
 		Stash struct {
 			Address  string `required:"true"`
 			Username string `required:"true"`
 			Password string `required:"true"`
 		} `required:"true"`
-		Linters map[string]string `required:"true"`
+		Linters map[string]interface{} `required:"true"`
+		Lint    struct {
+			InlineComments bool   `toml:"inline_comments"`
+			Mode           string `toml:"mode"`
+			Concurrency    int    `toml:"concurrency"`
+		}
+		Coverage struct {
+			Enabled    bool    `toml:"enabled"`
+			Minimum    float64 `toml:"minimum"`
+			NoDecrease bool    `toml:"no_decrease"`
+		}
 	} `required:"true"`
 }
 
 type resources struct {
-	config  *config
-	stash   stash.Stash
-	queue   *Queue
-	linters map[string]string
+	path            string
+	config          *config
+	stash           stash.Stash
+	stashAPI        *StashAPI
+	queue           *Queue
+	history         *History
+	coverage        *CoverageHistory
+	agents          *Agents
+	branches        *Branches
+	schedules       *Schedules
+	crons           []*cronSchedule
+	linters         map[string]Linter
+	shutdownTimeout time.Duration
+	taskTimeout     time.Duration
+	leaseTimeout    time.Duration
+	pollInterval    time.Duration
+	priorities      priorities
+	quota           quota
+	secrets         []Secret
+	tokens          []Token
 }
 
 func GetResources(path string) (*resources, error) {
@@ -53,14 +124,220 @@ func GetResources(path string) (*resources, error) {
 		)
 	}
 
+	shutdownTimeout := defaultShutdownTimeout
+	if config.Tasks.ShutdownTimeout != "" {
+		shutdownTimeout, err = time.ParseDuration(config.Tasks.ShutdownTimeout)
+		if err != nil {
+			return nil, hierr.Errorf(
+				err,
+				"can't parse tasks.shutdown_timeout",
+			)
+		}
+	}
+
+	var taskTimeout time.Duration
+	if config.Tasks.Timeout != "" {
+		taskTimeout, err = time.ParseDuration(config.Tasks.Timeout)
+		if err != nil {
+			return nil, hierr.Errorf(
+				err,
+				"can't parse tasks.timeout",
+			)
+		}
+	}
+
+	leaseTimeout := defaultLeaseTimeout
+	if config.Agents.LeaseTimeout != "" {
+		leaseTimeout, err = time.ParseDuration(config.Agents.LeaseTimeout)
+		if err != nil {
+			return nil, hierr.Errorf(
+				err,
+				"can't parse agents.lease_timeout",
+			)
+		}
+
+		if leaseTimeout <= 0 {
+			return nil, fmt.Errorf(
+				"agents.lease_timeout should be positive, got %s",
+				config.Agents.LeaseTimeout,
+			)
+		}
+	}
+
+	var pollInterval time.Duration
+	if config.Branches.PollInterval != "" {
+		pollInterval, err = time.ParseDuration(config.Branches.PollInterval)
+		if err != nil {
+			return nil, hierr.Errorf(
+				err,
+				"can't parse branches.poll_interval",
+			)
+		}
+	}
+
+	for _, url := range config.Branches.Watch {
+		_, err := NewTaskStashBranch(url)
+		if err != nil {
+			return nil, hierr.Errorf(
+				err,
+				"can't parse branches.watch URL %s", url,
+			)
+		}
+	}
+
+	priorities, err := parsePriorities(config.Tasks.Priorities)
+	if err != nil {
+		return nil, hierr.Errorf(
+			err,
+			"can't parse tasks.priorities",
+		)
+	}
+
+	quota, err := parseQuota(config.Tasks.Quota)
+	if err != nil {
+		return nil, hierr.Errorf(
+			err,
+			"can't parse tasks.quota",
+		)
+	}
+
+	secrets, err := loadSecrets(
+		config.Secrets.Variables, config.Secrets.File,
+	)
+	if err != nil {
+		return nil, hierr.Errorf(
+			err,
+			"can't load secrets",
+		)
+	}
+
+	tokens, err := loadTokens(config.Auth, config.Web.AdminToken)
+	if err != nil {
+		return nil, hierr.Errorf(
+			err,
+			"can't load auth tokens",
+		)
+	}
+
+	for name := range config.Steps {
+		if !isKnownStep(name) {
+			return nil, fmt.Errorf(
+				"unknown step '%s' in steps section, expected %s, %s, %s, %s or %s",
+				name, stepFetch, stepBuild, stepLint, stepTest, stepCoverage,
+			)
+		}
+	}
+
+	crons, err := parseSchedules(config.Schedules)
+	if err != nil {
+		return nil, hierr.Errorf(
+			err,
+			"can't parse schedules",
+		)
+	}
+
+	linters, err := parseLinters(config.Resources.Linters)
+	if err != nil {
+		return nil, hierr.Errorf(
+			err,
+			"can't parse resources.linters",
+		)
+	}
+
+	if config.Resources.Lint.Concurrency <= 0 {
+		config.Resources.Lint.Concurrency = runtime.NumCPU()
+	}
+
+	switch config.Resources.Lint.Mode {
+	case "":
+		config.Resources.Lint.Mode = lintModeAll
+
+	case lintModeAll, lintModeDiff, lintModeBaseline:
+
+	default:
+		return nil, fmt.Errorf(
+			"unknown resources.lint.mode '%s', expected %s, %s or %s",
+			config.Resources.Lint.Mode,
+			lintModeAll, lintModeDiff, lintModeBaseline,
+		)
+	}
+
+	var (
+		queue    = NewQueue(getLogger("queue"))
+		history  = NewHistory()
+		coverage = NewCoverageHistory()
+	)
+
+	queue.SetLimits(config.Tasks.Limits)
+	queue.SetPriorities(priorities)
+
+	stashAPI := NewStashAPI(
+		stashURL,
+		config.Resources.Stash.Username,
+		config.Resources.Stash.Password,
+	)
+
+	branches := NewBranches(getLogger("branches"), queue)
+	branches.SetWatch(stashAPI, config.Branches.Watch, pollInterval)
+
+	schedules := NewSchedules(getLogger("schedules"), queue)
+	schedules.SetSchedules(
+		stashAPI, config.Web.BasicURL, config.Schedules, crons,
+	)
+
 	return &resources{
 		stash: stash.NewClient(
 			config.Resources.Stash.Username,
 			config.Resources.Stash.Password,
 			stashURL,
 		),
-		queue:   NewQueue(getLogger("queue")),
-		linters: config.Resources.Linters,
-		config:  &config,
+		stashAPI: stashAPI,
+		queue:    queue,
+		history:  history,
+		coverage: coverage,
+		agents: NewAgents(
+			getLogger("agents"), queue, history, coverage, leaseTimeout,
+		),
+		branches:        branches,
+		schedules:       schedules,
+		crons:           crons,
+		linters:         linters,
+		path:            path,
+		config:          &config,
+		shutdownTimeout: shutdownTimeout,
+		taskTimeout:     taskTimeout,
+		leaseTimeout:    leaseTimeout,
+		pollInterval:    pollInterval,
+		priorities:      priorities,
+		quota:           quota,
+		secrets:         secrets,
+		tokens:          tokens,
 	}, nil
 }
+
+// inherit takes queue, builds and coverage history, registered agents,
+// watched branches and results of scheduled builds from previous resources,
+// so configuration can be reloaded without losing tasks.
+func (resources *resources) inherit(previous *resources) {
+	resources.queue = previous.queue
+	resources.history = previous.history
+	resources.coverage = previous.coverage
+	resources.agents = previous.agents
+	resources.branches = previous.branches
+	resources.schedules = previous.schedules
+
+	resources.queue.SetLimits(resources.config.Tasks.Limits)
+	resources.queue.SetPriorities(resources.priorities)
+	resources.agents.SetTimeout(resources.leaseTimeout)
+	resources.branches.SetWatch(
+		resources.stashAPI,
+		resources.config.Branches.Watch,
+		resources.pollInterval,
+	)
+	resources.schedules.SetSchedules(
+		resources.stashAPI,
+		resources.config.Web.BasicURL,
+		resources.config.Schedules,
+		resources.crons,
+	)
+}
@@ -1,5 +1,9 @@
 package main
 
+import (
+	"time"
+)
+
 type ResponseTaskQueued struct {
 	ID int64 `json:"id"`
 }
@@ -8,10 +12,98 @@ type ResponseTask struct {
 	UniqueID   int64    `json:"unique_id"`
 	Identifier string   `json:"identifier"`
 	State      string   `json:"state"`
+	Priority   string   `json:"priority"`
+	Labels     []string `json:"labels,omitempty"`
 	Title      string   `json:"title"`
 	Logs       []string `json:"logs,omitempty"`
+
+	LintFindings []LintFinding   `json:"lint_findings,omitempty"`
+	TestReport   *TestReport     `json:"test_report,omitempty"`
+	Coverage     *CoverageReport `json:"coverage,omitempty"`
+	Usage        *ResourceUsage  `json:"usage,omitempty"`
+	Environment  []string        `json:"environment,omitempty"`
+
+	Position        int        `json:"position,omitempty"`
+	Ahead           *int       `json:"ahead,omitempty"`
+	EstimatedStart  *time.Time `json:"estimated_start,omitempty"`
+	EstimatedFinish *time.Time `json:"estimated_finish,omitempty"`
+}
+
+func (response *ResponseTask) SetEstimate(estimate Estimate) {
+	if estimate.Position > 0 {
+		response.Position = estimate.Position
+		response.Ahead = &estimate.Ahead
+	}
+
+	if !estimate.StartAt.IsZero() {
+		response.EstimatedStart = &estimate.StartAt
+	}
+
+	if !estimate.FinishAt.IsZero() {
+		response.EstimatedFinish = &estimate.FinishAt
+	}
 }
 
 type ResponseTaskList struct {
 	Tasks []ResponseTask `json:"tasks"`
 }
+
+type ResponseScheduler struct {
+	State   string `json:"state"`
+	Drained bool   `json:"drained"`
+	Threads int    `json:"threads"`
+	Workers int    `json:"workers"`
+	Busy    int    `json:"busy"`
+	Queued  int    `json:"queued"`
+}
+
+type ResponseAgent struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Labels   []string  `json:"labels"`
+	Threads  int       `json:"threads"`
+	LastSeen time.Time `json:"last_seen"`
+	Tasks    []int64   `json:"tasks"`
+
+	// LeaseTimeout is returned only to the registered agent.
+	LeaseTimeout string `json:"lease_timeout,omitempty"`
+}
+
+type ResponseAgentList struct {
+	Agents []ResponseAgent `json:"agents"`
+}
+
+type ResponseLease struct {
+	ID       int64    `json:"id"`
+	Kind     string   `json:"kind"`
+	URL      string   `json:"url"`
+	Priority string   `json:"priority"`
+	Labels   []string `json:"labels"`
+	Approved bool     `json:"approved,omitempty"`
+	Commit   string   `json:"commit,omitempty"`
+
+	LeaseTimeout string `json:"lease_timeout"`
+}
+
+// ResponseRaw is written as is instead of being encoded into JSON.
+type ResponseRaw struct {
+	ContentType string
+	Body        []byte
+}
+
+type ResponseCoverage struct {
+	TaskID     int64     `json:"task_id"`
+	Commit     string    `json:"commit"`
+	Coverage   float64   `json:"coverage"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+type ResponseCoverageHistory struct {
+	Repository string             `json:"repository"`
+	Branch     string             `json:"branch"`
+	Builds     []ResponseCoverage `json:"builds"`
+}
+
+type ResponseHook struct {
+	Tasks []int64 `json:"tasks"`
+}
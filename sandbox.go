@@ -0,0 +1,97 @@
+package main
+
+import (
+	"path/filepath"
+)
+
+// sandboxHelperCommand is a hidden command of uroboros binary which prepares
+// sandbox and runs build command in it, uroboros re-executes itself with this
+// command in new namespaces.
+const sandboxHelperCommand = "__sandbox"
+
+// SandboxOverride is a sandbox configuration of the repository, configured
+// in sandbox.repositories section by the repository slug:
+//
+//	[sandbox.repositories."git.local/prj/repo"]
+//	  enabled = false
+type SandboxOverride struct {
+	Enabled  *bool
+	Writable []string
+	Hidden   []string
+}
+
+// sandboxSpec describes sandbox of the single command, it's passed to the
+// sandbox helper as JSON.
+type sandboxSpec struct {
+	// Root is an empty directory where the host filesystem is mounted
+	// read-only before chroot, filesystem is not isolated if it's empty.
+	Root string
+
+	// Dir is a working directory of the command.
+	Dir string
+
+	// Writable are paths which are kept writable, like the workspace and
+	// caches.
+	Writable []string
+
+	// Hidden are paths which are replaced by empty ones, like the
+	// configuration file of uroboros.
+	Hidden []string
+
+	// DisableNetwork runs the command in new network namespace which has
+	// only loopback interface.
+	DisableNetwork bool
+}
+
+// getSandbox returns sandbox settings of the task repository, settings of
+// policy are applied to untrusted builds, returns false if the task should not
+// be sandboxed.
+func (resources *resources) getSandbox(
+	task Task, untrusted bool,
+) (sandboxSpec, bool) {
+	var (
+		config  = resources.config.Sandbox
+		enabled = config.Enabled
+		spec    = sandboxSpec{
+			Writable: append([]string{}, config.Writable...),
+			Hidden:   append([]string{resources.path}, config.Hidden...),
+		}
+	)
+
+	for _, path := range []string{
+		resources.config.Secrets.File,
+		resources.config.Auth.File,
+	} {
+		if path != "" {
+			spec.Hidden = append(spec.Hidden, path)
+		}
+	}
+
+	overrides := []SandboxOverride{}
+
+	if override, ok := config.Repositories[getRepositorySlug(task)]; ok {
+		overrides = append(overrides, override)
+	}
+
+	if untrusted {
+		overrides = append(overrides, resources.config.Policy.Sandbox)
+	}
+
+	for _, override := range overrides {
+		if override.Enabled != nil {
+			enabled = *override.Enabled
+		}
+
+		spec.Writable = append(spec.Writable, override.Writable...)
+		spec.Hidden = append(spec.Hidden, override.Hidden...)
+	}
+
+	for i, path := range spec.Hidden {
+		absolute, err := filepath.Abs(path)
+		if err == nil {
+			spec.Hidden[i] = absolute
+		}
+	}
+
+	return spec, enabled
+}
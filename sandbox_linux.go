@@ -0,0 +1,443 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/reconquest/hierr-go"
+)
+
+// sandboxExitCode is an exit code of the sandbox helper when sandbox can't
+// be prepared.
+const sandboxExitCode = 125
+
+// prctl and capset constants which are missing in syscall package.
+const (
+	prCapbsetDrop           = 24
+	prSetNoNewPrivs         = 38
+	prCapAmbient            = 47
+	prCapAmbientClearAll    = 4
+	linuxCapabilityVersion3 = 0x20080522
+)
+
+// statfs flags which are locked in user namespace and should be kept when
+// mount is remounted read-only.
+var sandboxMountFlags = []struct {
+	statfs int64
+	mount  uintptr
+}{
+	{1, syscall.MS_RDONLY},
+	{2, syscall.MS_NOSUID},
+	{4, syscall.MS_NODEV},
+	{8, syscall.MS_NOEXEC},
+	{1024, syscall.MS_NOATIME},
+	{2048, syscall.MS_NODIRATIME},
+	{4096, syscall.MS_RELATIME},
+}
+
+// sandboxCommand makes the command run through sandbox helper in new user,
+// mount, pid, ipc and uts namespaces and in new network namespace if network
+// is disabled. User of uroboros is mapped to root of the user namespace, so
+// the helper keeps capabilities in the namespace after exec even if uroboros
+// is not run by root, the helper drops them before running the command.
+func sandboxCommand(cmd *exec.Cmd, spec sandboxSpec) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return hierr.Errorf(err, "can't obtain path of uroboros executable")
+	}
+
+	if spec.Dir == "" {
+		spec.Dir = cmd.Dir
+	}
+
+	encoded, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+
+	cmd.Args = append(
+		[]string{executable, sandboxHelperCommand, string(encoded)},
+		cmd.Args...,
+	)
+	cmd.Path = executable
+
+	flags := uintptr(
+		syscall.CLONE_NEWUSER |
+			syscall.CLONE_NEWNS |
+			syscall.CLONE_NEWPID |
+			syscall.CLONE_NEWIPC |
+			syscall.CLONE_NEWUTS,
+	)
+
+	if spec.DisableNetwork {
+		flags |= syscall.CLONE_NEWNET
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: flags,
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getuid(), Size: 1},
+		},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getgid(), Size: 1},
+		},
+		GidMappingsEnableSetgroups: false,
+		Pdeathsig:                  syscall.SIGKILL,
+	}
+
+	return nil
+}
+
+// runSandboxHelper prepares sandbox described by the first argument and runs
+// the command specified by the rest of arguments without any capabilities,
+// exits with exit code of the command.
+func runSandboxHelper(args []string) {
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "sandbox: command is not specified")
+		os.Exit(sandboxExitCode)
+	}
+
+	// capabilities are per thread, so the command should be started from
+	// the same thread which dropped them.
+	runtime.LockOSThread()
+
+	var spec sandboxSpec
+	err := json.Unmarshal([]byte(args[0]), &spec)
+	if err == nil {
+		err = spec.setup()
+	}
+
+	if err == nil {
+		err = dropPrivileges()
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %s\n", err)
+		os.Exit(sandboxExitCode)
+	}
+
+	cmd := exec.Command(args[1], args[2:]...)
+	cmd.Dir = spec.Dir
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+	if err == nil {
+		os.Exit(0)
+	}
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		status := exitErr.Sys().(syscall.WaitStatus)
+		if status.Signaled() {
+			os.Exit(128 + int(status.Signal()))
+		}
+
+		os.Exit(status.ExitStatus())
+	}
+
+	fmt.Fprintf(os.Stderr, "sandbox: %s\n", err)
+	os.Exit(sandboxExitCode)
+}
+
+// setup brings loopback interface up if network is disabled, mounts host
+// filesystem read-only into the root directory, mounts private /tmp, writable
+// paths and /proc, hides given paths and changes root directory of the
+// process. It requires capabilities of root of the user namespace, which are
+// dropped after setup, see dropPrivileges.
+func (spec sandboxSpec) setup() error {
+	if spec.DisableNetwork {
+		err := setupLoopback()
+		if err != nil {
+			return hierr.Errorf(err, "can't bring loopback interface up")
+		}
+	}
+
+	if spec.Root == "" {
+		return nil
+	}
+
+	err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return hierr.Errorf(err, "can't make mounts private")
+	}
+
+	err = syscall.Mount("/", spec.Root, "", syscall.MS_BIND|syscall.MS_REC, "")
+	if err != nil {
+		return hierr.Errorf(err, "can't bind host filesystem to %s", spec.Root)
+	}
+
+	mounts, err := getMountPoints(spec.Root)
+	if err != nil {
+		return err
+	}
+
+	for _, mount := range mounts {
+		err = remountReadOnly(mount)
+		if err != nil {
+			return hierr.Errorf(err, "can't remount %s read-only", mount)
+		}
+	}
+
+	err = syscall.Mount(
+		"tmpfs", filepath.Join(spec.Root, "tmp"), "tmpfs",
+		syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777",
+	)
+	if err != nil {
+		return hierr.Errorf(err, "can't mount private /tmp")
+	}
+
+	// workspace is usually located in /tmp, so mount point should be
+	// created in private /tmp.
+	for _, path := range spec.Writable {
+		target := filepath.Join(spec.Root, path)
+
+		err = os.MkdirAll(target, 0755)
+		if err != nil {
+			return hierr.Errorf(err, "can't create mount point %s", path)
+		}
+
+		err = syscall.Mount(
+			path, target, "", syscall.MS_BIND|syscall.MS_REC, "",
+		)
+		if err != nil {
+			return hierr.Errorf(err, "can't bind writable %s", path)
+		}
+	}
+
+	for _, path := range spec.Hidden {
+		err = hidePath(filepath.Join(spec.Root, path))
+		if err != nil {
+			return hierr.Errorf(err, "can't hide %s", path)
+		}
+	}
+
+	err = syscall.Mount(
+		"proc", filepath.Join(spec.Root, "proc"), "proc",
+		syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "",
+	)
+	if err != nil {
+		return hierr.Errorf(err, "can't mount /proc")
+	}
+
+	err = syscall.Chroot(spec.Root)
+	if err != nil {
+		return hierr.Errorf(err, "can't change root to %s", spec.Root)
+	}
+
+	err = os.Chdir(spec.Dir)
+	if err != nil {
+		return hierr.Errorf(err, "can't change directory to %s", spec.Dir)
+	}
+
+	return nil
+}
+
+// dropPrivileges drops all capabilities of the current thread including
+// bounding and ambient sets, so the command started from this thread can't
+// undo mounts of the sandbox, even though it's run by root of the user
+// namespace, and can't gain privileges through setuid binaries.
+func dropPrivileges() error {
+	_, _, errno := syscall.RawSyscall6(
+		syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClearAll, 0, 0, 0, 0,
+	)
+	// ambient capabilities are not supported by kernels older than 4.3.
+	if errno != 0 && errno != syscall.EINVAL {
+		return hierr.Errorf(errno, "can't clear ambient capabilities")
+	}
+
+	for capability := uintptr(0); ; capability++ {
+		_, _, errno = syscall.RawSyscall(
+			syscall.SYS_PRCTL, prCapbsetDrop, capability, 0,
+		)
+		if errno == syscall.EINVAL {
+			break
+		}
+
+		if errno != 0 {
+			return hierr.Errorf(
+				errno, "can't drop capability %d from bounding set", capability,
+			)
+		}
+	}
+
+	_, _, errno = syscall.RawSyscall6(
+		syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0,
+	)
+	if errno != 0 {
+		return hierr.Errorf(errno, "can't set no_new_privs")
+	}
+
+	var (
+		header = struct {
+			version uint32
+			pid     int32
+		}{version: linuxCapabilityVersion3}
+
+		data [2]struct {
+			effective   uint32
+			permitted   uint32
+			inheritable uint32
+		}
+	)
+
+	_, _, errno = syscall.RawSyscall(
+		syscall.SYS_CAPSET,
+		uintptr(unsafe.Pointer(&header)),
+		uintptr(unsafe.Pointer(&data[0])),
+		0,
+	)
+	if errno != 0 {
+		return hierr.Errorf(errno, "can't drop capabilities")
+	}
+
+	return nil
+}
+
+// getMountPoints returns mount points which are located in the given
+// directory, mount points are returned in order of mounting, so parents go
+// before children.
+func getMountPoints(root string) ([]string, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	mounts := []string{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+
+		mount, err := unescapeMountPoint(fields[4])
+		if err != nil {
+			return nil, err
+		}
+
+		if mount == root || strings.HasPrefix(mount, root+"/") {
+			mounts = append(mounts, mount)
+		}
+	}
+
+	return mounts, scanner.Err()
+}
+
+// unescapeMountPoint decodes octal escapes like \040 used in mountinfo.
+func unescapeMountPoint(value string) (string, error) {
+	var result strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+3 < len(value) {
+			code, err := strconv.ParseUint(value[i+1:i+4], 8, 8)
+			if err != nil {
+				return "", fmt.Errorf("invalid mount point %q", value)
+			}
+
+			result.WriteByte(byte(code))
+			i += 3
+
+			continue
+		}
+
+		result.WriteByte(value[i])
+	}
+
+	return result.String(), nil
+}
+
+// remountReadOnly remounts bind mount read-only keeping flags which can't be
+// cleared in user namespace.
+func remountReadOnly(mount string) error {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(mount, &stat)
+	if err != nil {
+		return err
+	}
+
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	for _, flag := range sandboxMountFlags {
+		if int64(stat.Flags)&flag.statfs != 0 {
+			flags |= flag.mount
+		}
+	}
+
+	return syscall.Mount("", mount, "", flags, "")
+}
+
+// setupLoopback brings loopback interface of the network namespace up, it's
+// down in new network namespace.
+func setupLoopback() error {
+	socket, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+
+	defer syscall.Close(socket)
+
+	// struct ifreq with ifr_flags
+	var request struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+
+	copy(request.name[:], "lo")
+
+	for _, operation := range []uintptr{
+		syscall.SIOCGIFFLAGS, syscall.SIOCSIFFLAGS,
+	} {
+		if operation == syscall.SIOCSIFFLAGS {
+			request.flags |= syscall.IFF_UP | syscall.IFF_RUNNING
+		}
+
+		_, _, errno := syscall.Syscall(
+			syscall.SYS_IOCTL,
+			uintptr(socket),
+			operation,
+			uintptr(unsafe.Pointer(&request)),
+		)
+		if errno != 0 {
+			return errno
+		}
+	}
+
+	return nil
+}
+
+// hidePath replaces directory with empty read-only tmpfs and file with
+// /dev/null, missing paths are skipped.
+func hidePath(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	if info.IsDir() {
+		return syscall.Mount(
+			"tmpfs", path, "tmpfs",
+			syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, "",
+		)
+	}
+
+	return syscall.Mount("/dev/null", path, "", syscall.MS_BIND, "")
+}
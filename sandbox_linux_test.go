@@ -0,0 +1,333 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+const (
+	// sandboxProbeVariable makes the test binary run the probe instead of
+	// tests, the probe is run as the build command inside the sandbox.
+	sandboxProbeVariable = "UROBOROS_SANDBOX_PROBE"
+
+	sandboxUnprivilegedUID = 65534
+)
+
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == sandboxHelperCommand {
+		runSandboxHelper(os.Args[2:])
+	}
+
+	if probe := os.Getenv(sandboxProbeVariable); probe != "" {
+		os.Exit(runSandboxProbe(probe, os.Args[1:]))
+	}
+
+	os.Exit(m.Run())
+}
+
+// runSandboxProbe tries to break out of the sandbox, prints every attempt
+// which succeeded and returns non-zero exit code if any did.
+func runSandboxProbe(probe string, args []string) int {
+	failures := []string{}
+
+	switch probe {
+	case "isolation":
+		var (
+			hiddenFile = args[0]
+			hiddenDir  = args[1]
+		)
+
+		for _, path := range []string{hiddenFile, hiddenDir, "/", "/proc"} {
+			err := syscall.Unmount(path, syscall.MNT_DETACH)
+			if err == nil {
+				failures = append(failures, "unmounted "+path)
+			}
+		}
+
+		err := syscall.Mount(
+			"", "/", "", syscall.MS_REMOUNT|syscall.MS_BIND, "",
+		)
+		if err == nil {
+			failures = append(failures, "remounted / read-write")
+		}
+
+		err = syscall.Mount("tmpfs", hiddenDir, "tmpfs", 0, "")
+		if err == nil {
+			failures = append(failures, "mounted tmpfs over "+hiddenDir)
+		}
+
+		contents, err := ioutil.ReadFile(hiddenFile)
+		if err != nil || len(contents) > 0 {
+			failures = append(failures, fmt.Sprintf(
+				"hidden file is readable: %q, %v", contents, err,
+			))
+		}
+
+		probe := "/.uroboros-sandbox-probe"
+		err = ioutil.WriteFile(probe, []byte{}, 0600)
+		if err == nil {
+			os.Remove(probe)
+			failures = append(failures, "wrote into read-only /")
+		}
+
+		status, err := ioutil.ReadFile("/proc/self/status")
+		if err != nil {
+			failures = append(failures, err.Error())
+		}
+
+		for _, line := range strings.Split(string(status), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				continue
+			}
+
+			switch fields[0] {
+			case "CapInh:", "CapPrm:", "CapEff:", "CapBnd:", "CapAmb:":
+				if strings.Trim(fields[1], "0") != "" {
+					failures = append(failures, "has capabilities: "+line)
+				}
+
+			case "NoNewPrivs:":
+				if fields[1] != "1" {
+					failures = append(failures, "no_new_privs is not set")
+				}
+			}
+		}
+
+	case "loopback":
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			failures = append(failures, "can't listen on loopback: "+err.Error())
+			break
+		}
+
+		defer listener.Close()
+
+		go func() {
+			connection, err := listener.Accept()
+			if err == nil {
+				connection.Close()
+			}
+		}()
+
+		connection, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			failures = append(failures, "can't dial loopback: "+err.Error())
+		} else {
+			connection.Close()
+		}
+
+		interfaces, err := net.Interfaces()
+		if err != nil {
+			failures = append(failures, err.Error())
+		}
+
+		for _, link := range interfaces {
+			if link.Flags&net.FlagLoopback == 0 {
+				failures = append(failures, "network is available: "+link.Name)
+			}
+		}
+
+	default:
+		failures = append(failures, "unknown probe "+probe)
+	}
+
+	for _, failure := range failures {
+		fmt.Println(failure)
+	}
+
+	if len(failures) > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// runSandboxed runs the probe in the sandbox, skips the test if sandbox is
+// not supported by the kernel.
+func runSandboxed(
+	t *testing.T,
+	spec sandboxSpec,
+	probe string,
+	args ...string,
+) (string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := exec.Command("true")
+	err = sandboxCommand(check, sandboxSpec{})
+	if err == nil {
+		err = check.Run()
+	}
+
+	if err != nil {
+		t.Skipf("user namespaces are not available: %s", err)
+	}
+
+	// the test binary is located in /tmp, which is private in the sandbox.
+	spec.Writable = append(spec.Writable, filepath.Dir(executable))
+
+	cmd := exec.Command(executable, args...)
+	cmd.Env = append(os.Environ(), sandboxProbeVariable+"="+probe)
+
+	err = sandboxCommand(cmd, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := cmd.CombinedOutput()
+
+	return string(output), err
+}
+
+// runUnprivileged re-executes the test by unprivileged user if tests are run
+// by root, returns false if the test should be run by the current user.
+func runUnprivileged(t *testing.T, name string) bool {
+	if os.Getuid() != 0 {
+		return false
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// directory of the test binary is not accessible by other users.
+	directory, err := ioutil.TempDir("", "uroboros_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(directory)
+
+	err = os.Chmod(directory, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := ioutil.ReadFile(executable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copied := filepath.Join(directory, filepath.Base(executable))
+
+	err = ioutil.WriteFile(copied, contents, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+
+	cmd := exec.Command(copied, "-test.run", "^"+name+"$", "-test.v")
+	cmd.Dir = directory
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{
+			Uid: sandboxUnprivilegedUID,
+			Gid: sandboxUnprivilegedUID,
+		},
+	}
+
+	err = cmd.Run()
+
+	t.Logf("unprivileged run:\n%s", output.String())
+
+	if err != nil {
+		t.Fatalf("unprivileged run failed: %s", err)
+	}
+
+	if strings.Contains(output.String(), "--- SKIP") {
+		t.Skip("skipped by unprivileged user")
+	}
+
+	return true
+}
+
+func testSandboxIsolation(t *testing.T) {
+	var (
+		workspace  = t.TempDir()
+		root       = filepath.Join(workspace, ".sandbox")
+		hiddenFile = filepath.Join(workspace, "secret")
+		hiddenDir  = filepath.Join(workspace, "private")
+	)
+
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(hiddenFile, []byte("hunter2"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.MkdirAll(hiddenDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := runSandboxed(
+		t,
+		sandboxSpec{
+			Root:     root,
+			Dir:      workspace,
+			Writable: []string{workspace},
+			Hidden:   []string{hiddenFile, hiddenDir},
+		},
+		"isolation",
+		hiddenFile, hiddenDir,
+	)
+	if err != nil {
+		t.Fatalf("sandbox isolation is broken: %s\n%s", err, output)
+	}
+}
+
+func TestSandboxCommand_CantUndoIsolation(t *testing.T) {
+	testSandboxIsolation(t)
+}
+
+func TestSandboxCommand_CantUndoIsolationAsUnprivileged(t *testing.T) {
+	if runUnprivileged(t, "TestSandboxCommand_CantUndoIsolation") {
+		return
+	}
+
+	testSandboxIsolation(t)
+}
+
+func testSandboxLoopback(t *testing.T) {
+	output, err := runSandboxed(
+		t,
+		sandboxSpec{DisableNetwork: true},
+		"loopback",
+	)
+	if err != nil {
+		t.Fatalf("loopback is not available without network: %s\n%s", err, output)
+	}
+}
+
+func TestSandboxCommand_LoopbackWithoutNetwork(t *testing.T) {
+	testSandboxLoopback(t)
+}
+
+func TestSandboxCommand_LoopbackWithoutNetworkAsUnprivileged(t *testing.T) {
+	if runUnprivileged(t, "TestSandboxCommand_LoopbackWithoutNetwork") {
+		return
+	}
+
+	testSandboxLoopback(t)
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+func sandboxCommand(cmd *exec.Cmd, spec sandboxSpec) error {
+	return errors.New("sandbox is supported only on linux")
+}
+
+func runSandboxHelper(args []string) {
+	fmt.Fprintln(os.Stderr, "sandbox: supported only on linux")
+	os.Exit(1)
+}
@@ -1,50 +1,356 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/kovetskiy/lorg"
 )
 
+type SchedulerState int
+
+const (
+	SchedulerStateRunning  SchedulerState = 10
+	SchedulerStatePaused   SchedulerState = 20
+	SchedulerStateDraining SchedulerState = 30
+	SchedulerStateDrained  SchedulerState = 40
+)
+
+func (state SchedulerState) String() string {
+	switch state {
+	case SchedulerStateRunning:
+		return "running"
+	case SchedulerStatePaused:
+		return "paused"
+	case SchedulerStateDraining:
+		return "draining"
+	case SchedulerStateDrained:
+		return "drained"
+	default:
+		return "unknown"
+	}
+}
+
 type Scheduler struct {
 	logger    *lorg.Log
 	resources *resources
 	scheduled int64
+	state     SchedulerState
+	threads   int
+	workers   int
+	busy      int
+	mutex     *sync.Mutex
+	cond      *sync.Cond
+}
+
+type SchedulerStatus struct {
+	State   SchedulerState
+	Drained bool
+	Threads int
+	Workers int
+	Busy    int
 }
 
 func NewScheduler(
 	logger *lorg.Log,
 	resources *resources,
 ) *Scheduler {
-	return &Scheduler{
+	scheduler := &Scheduler{
 		logger:    logger,
 		resources: resources,
+		state:     SchedulerStateRunning,
+		mutex:     &sync.Mutex{},
 	}
+
+	scheduler.cond = sync.NewCond(scheduler.mutex)
+
+	return scheduler
 }
 
 func (scheduler *Scheduler) Schedule(threads int) {
-	for i := 1; i <= threads; i++ {
-		scheduler.logger.Infof("[%d/%d] spawning thread", i, threads)
+	scheduler.SetThreads(threads)
+}
+
+// SetThreads changes amount of worker threads, extra threads finish their
+// current tasks and exit, missing threads are spawned immediately.
+func (scheduler *Scheduler) SetThreads(threads int) {
+	scheduler.mutex.Lock()
+
+	scheduler.logger.Infof(
+		"changing amount of threads: %d -> %d",
+		scheduler.threads, threads,
+	)
+
+	scheduler.threads = threads
+	for scheduler.workers < scheduler.threads {
+		scheduler.workers++
+
+		scheduler.logger.Infof(
+			"[%d/%d] spawning thread",
+			scheduler.workers, scheduler.threads,
+		)
+
 		go scheduler.schedule()
 	}
+
+	scheduler.mutex.Unlock()
+
+	scheduler.wake()
 }
 
-func (scheduler *Scheduler) schedule() {
+func (scheduler *Scheduler) Pause() {
+	scheduler.setState(SchedulerStatePaused)
+}
+
+func (scheduler *Scheduler) Resume() {
+	scheduler.setState(SchedulerStateRunning)
+}
+
+// Drain stops picking up new tasks by scheduler and agents, queued tasks
+// will wait until scheduler is resumed. Scheduler becomes drained when all
+// running tasks, including tasks leased by agents, are finished, see
+// WaitDrained.
+func (scheduler *Scheduler) Drain() {
+	scheduler.mutex.Lock()
+	state := scheduler.state
+	scheduler.mutex.Unlock()
+
+	if state == SchedulerStateDraining || state == SchedulerStateDrained {
+		return
+	}
+
+	scheduler.setState(SchedulerStateDraining)
+
+	go scheduler.drain()
+}
+
+// drain waits until all running tasks are finished and marks scheduler
+// drained unless it was resumed or paused in the meantime.
+func (scheduler *Scheduler) drain() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		// queue lock should never be acquired under scheduler lock, because
+		// queue calls isInterrupted while holding own lock.
+		running := scheduler.getResources().queue.GetRunningCount()
+
+		scheduler.mutex.Lock()
+		if scheduler.state != SchedulerStateDraining {
+			scheduler.mutex.Unlock()
+			return
+		}
+
+		if running == 0 {
+			scheduler.state = SchedulerStateDrained
+			scheduler.mutex.Unlock()
+
+			scheduler.logger.Infof(
+				"%s -> %s, all running tasks are finished",
+				SchedulerStateDraining, SchedulerStateDrained,
+			)
+
+			return
+		}
+		scheduler.mutex.Unlock()
+
+		<-ticker.C
+	}
+}
+
+// WaitDrained blocks until scheduler is drained, returns false if context is
+// done or scheduler was resumed or paused before it was drained.
+func (scheduler *Scheduler) WaitDrained(ctx context.Context) bool {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
 	for {
-		task := scheduler.resources.queue.Pop()
+		switch scheduler.GetStatus().State {
+		case SchedulerStateDrained:
+			return true
+
+		case SchedulerStateDraining:
+
+		default:
+			return false
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+func (scheduler *Scheduler) GetStatus() SchedulerStatus {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	return SchedulerStatus{
+		State:   scheduler.state,
+		Drained: scheduler.state == SchedulerStateDrained,
+		Threads: scheduler.threads,
+		Workers: scheduler.workers,
+		Busy:    scheduler.busy,
+	}
+}
+
+func (scheduler *Scheduler) GetThreads() int {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	return scheduler.threads
+}
+
+// Wait blocks until all running tasks are finished or context is done,
+// returns false in the latter case.
+func (scheduler *Scheduler) Wait(ctx context.Context) bool {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for scheduler.getResources().queue.GetRunningCount() > 0 {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+
+	return true
+}
+
+func (scheduler *Scheduler) SetResources(resources *resources) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	scheduler.resources = resources
+}
+
+func (scheduler *Scheduler) getResources() *resources {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	return scheduler.resources
+}
+
+func (scheduler *Scheduler) setState(state SchedulerState) {
+	scheduler.mutex.Lock()
+
+	scheduler.logger.Infof("%s -> %s", scheduler.state, state)
+
+	scheduler.state = state
+
+	scheduler.mutex.Unlock()
+
+	scheduler.wake()
+}
+
+func (scheduler *Scheduler) wake() {
+	scheduler.cond.Broadcast()
+	scheduler.getResources().queue.Wake()
+}
+
+func (scheduler *Scheduler) schedule() {
+	for scheduler.wait() {
+		resources := scheduler.getResources()
+
+		task := resources.queue.Pop(
+			resources.config.Tasks.Labels,
+			scheduler.isInterrupted,
+		)
+		if task == nil {
+			continue
+		}
+
+		scheduler.setBusy(1)
+
 		scheduler.serve(task)
+		scheduler.getResources().queue.Done(task)
+
+		scheduler.setBusy(-1)
 	}
 }
 
+// wait blocks until scheduler is allowed to pick up new tasks, returns false
+// if the calling thread is not needed anymore and should exit.
+func (scheduler *Scheduler) wait() bool {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	for {
+		if scheduler.workers > scheduler.threads {
+			scheduler.workers--
+
+			scheduler.logger.Infof(
+				"[%d/%d] thread exited",
+				scheduler.workers, scheduler.threads,
+			)
+
+			return false
+		}
+
+		if scheduler.state == SchedulerStateRunning {
+			return true
+		}
+
+		scheduler.cond.Wait()
+	}
+}
+
+func (scheduler *Scheduler) isInterrupted() bool {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	return scheduler.state != SchedulerStateRunning ||
+		scheduler.workers > scheduler.threads
+}
+
+func (scheduler *Scheduler) setBusy(delta int) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	scheduler.busy += delta
+
+	scheduler.cond.Broadcast()
+}
+
 func (scheduler *Scheduler) serve(task Task) {
 	atomic.AddInt64(&scheduler.scheduled, 1)
 
 	scheduler.logger.Infof("serving task#%d", task.GetUniqueID())
 	scheduler.logger.Tracef("%#v", task)
 
-	logger := scheduler.logger.NewChildWithPrefix(
+	processor := NewProcessor(task)
+	processor.SetResources(scheduler.getResources())
+	processor.SetLogger(
+		getTaskLogger(
+			scheduler.logger, task,
+			newSecretMasker(scheduler.getResources().getSecrets(task)),
+		),
+	)
+	processor.Process()
+
+	if task.GetState() == TaskStateAwaitingApproval {
+		return
+	}
+
+	task.SetFinishedAt(time.Now())
+
+	scheduler.getResources().history.Add(task)
+	scheduler.getResources().coverage.Add(task)
+}
+
+// getTaskLogger returns child logger which writes messages to the task
+// buffers besides of stderr, values of secrets are masked in the buffers.
+func getTaskLogger(
+	parent *lorg.Log, task Task, masker *secretMasker,
+) *lorg.Log {
+	logger := parent.NewChildWithPrefix(
 		fmt.Sprintf("[task#%d]", task.GetUniqueID()),
 	)
 
@@ -54,21 +360,18 @@ func (scheduler *Scheduler) serve(task Task) {
 		).SetLevelWriterCondition(
 			lorg.LevelError,
 			os.Stderr,
-			uncolored{unprefixed{task.GetBuffer()}},
-			uncolored{unprefixed{task.GetErrorBuffer()}},
+			uncolored{unprefixed{masked{task.GetBuffer(), masker}}},
+			uncolored{unprefixed{masked{task.GetErrorBuffer(), masker}}},
 		).SetLevelWriterCondition(
 			lorg.LevelWarning,
 			os.Stderr,
-			uncolored{unprefixed{task.GetBuffer()}},
+			uncolored{unprefixed{masked{task.GetBuffer(), masker}}},
 		).SetLevelWriterCondition(
 			lorg.LevelInfo,
 			os.Stderr,
-			uncolored{unprefixed{task.GetBuffer()}},
+			uncolored{unprefixed{masked{task.GetBuffer(), masker}}},
 		),
 	)
 
-	processor := NewProcessor(task)
-	processor.SetResources(scheduler.resources)
-	processor.SetLogger(logger)
-	processor.Process()
+	return logger
 }
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kovetskiy/lorg"
+	"github.com/reconquest/hierr-go"
+)
+
+var (
+	reStashRepositoryURL = regexp.MustCompile(
+		`^https?://.*/(users|projects)/[^/]+/repos/[^/]+$`,
+	)
+	reStashProjectURL = regexp.MustCompile(
+		`^https?://.*/projects/([^/]+)$`,
+	)
+)
+
+// Schedule is a periodical build of the branch of repositories, configured
+// in schedules section:
+//
+//	[[schedules]]
+//	  cron = "0 3 * * *"
+//	  branch = "master"
+//	  repositories = ["http://git.local/projects/PRJ/repos/repo"]
+//	  projects = ["http://git.local/projects/OTHER"]
+//	  notify_url = "http://chat.local/hooks/ci"
+type Schedule struct {
+	Cron         string
+	Branch       string
+	Repositories []string
+	Projects     []string
+	NotifyURL    string `toml:"notify_url"`
+}
+
+type scheduledBuild struct {
+	identifier string
+	notifyURL  string
+}
+
+// Schedules pushes scheduled branch builds into the queue and notifies when
+// scheduled build of the branch fails after the previous one passed.
+type Schedules struct {
+	logger    *lorg.Log
+	queue     *Queue
+	stashAPI  *StashAPI
+	basicURL  string
+	schedules []Schedule
+	crons     []*cronSchedule
+	builds    map[int64]scheduledBuild
+	states    map[string]TaskState
+	client    *http.Client
+	mutex     *sync.Mutex
+}
+
+func NewSchedules(logger *lorg.Log, queue *Queue) *Schedules {
+	return &Schedules{
+		logger: logger,
+		queue:  queue,
+		builds: map[int64]scheduledBuild{},
+		states: map[string]TaskState{},
+		client: &http.Client{Timeout: time.Minute},
+		mutex:  &sync.Mutex{},
+	}
+}
+
+func parseSchedules(schedules []Schedule) ([]*cronSchedule, error) {
+	crons := []*cronSchedule{}
+	for i, schedule := range schedules {
+		cron, err := parseCronSchedule(schedule.Cron)
+		if err != nil {
+			return nil, hierr.Errorf(err, "schedule #%d", i+1)
+		}
+
+		if schedule.Branch == "" {
+			return nil, fmt.Errorf("schedule #%d: branch is not set", i+1)
+		}
+
+		for _, repository := range schedule.Repositories {
+			if !reStashRepositoryURL.MatchString(
+				strings.TrimSuffix(repository, "/"),
+			) {
+				return nil, fmt.Errorf(
+					"schedule #%d: URL %s doesn't seem like Stash repository",
+					i+1, repository,
+				)
+			}
+		}
+
+		for _, project := range schedule.Projects {
+			if !reStashProjectURL.MatchString(
+				strings.TrimSuffix(project, "/"),
+			) {
+				return nil, fmt.Errorf(
+					"schedule #%d: URL %s doesn't seem like Stash project",
+					i+1, project,
+				)
+			}
+		}
+
+		crons = append(crons, cron)
+	}
+
+	return crons, nil
+}
+
+// SetSchedules replaces schedules, schedules should be already validated by
+// parseSchedules.
+func (schedules *Schedules) SetSchedules(
+	stashAPI *StashAPI,
+	basicURL string,
+	list []Schedule,
+	crons []*cronSchedule,
+) {
+	schedules.mutex.Lock()
+	defer schedules.mutex.Unlock()
+
+	schedules.stashAPI = stashAPI
+	schedules.basicURL = basicURL
+	schedules.schedules = list
+	schedules.crons = crons
+}
+
+// Watch runs schedules at the beginning of every minute which matches their
+// cron expressions and checks results of previously pushed builds.
+func (schedules *Schedules) Watch() {
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+
+		schedules.check()
+
+		schedules.mutex.Lock()
+		var (
+			list  = schedules.schedules
+			crons = schedules.crons
+		)
+		schedules.mutex.Unlock()
+
+		now = time.Now()
+		for i, schedule := range list {
+			if crons[i].Match(now) {
+				schedules.run(schedule)
+			}
+		}
+	}
+}
+
+func (schedules *Schedules) run(schedule Schedule) {
+	schedules.logger.Infof(
+		"running schedule '%s' of branch %s", schedule.Cron, schedule.Branch,
+	)
+
+	for _, repository := range schedules.getRepositories(schedule) {
+		task, err := NewTaskStashBranch(
+			repository + "/browse?at=" +
+				url.QueryEscape("refs/heads/"+schedule.Branch),
+		)
+		if err != nil {
+			schedules.logger.Error(err)
+			continue
+		}
+
+		task.SetPriority(
+			schedules.queue.GetDefaultPriority(task, triggerSchedule),
+		)
+
+		id, queued := schedules.queue.PushOnce(task)
+		if !queued {
+			schedules.logger.Infof(
+				"build of %s is already queued as task#%d",
+				task.GetIdentifier(), id,
+			)
+			continue
+		}
+
+		schedules.logger.Infof(
+			"queued scheduled build task#%d of %s", id, task.GetIdentifier(),
+		)
+
+		schedules.mutex.Lock()
+		schedules.builds[id] = scheduledBuild{
+			identifier: task.GetIdentifier(),
+			notifyURL:  schedule.NotifyURL,
+		}
+		schedules.mutex.Unlock()
+	}
+}
+
+// getRepositories returns URLs of repositories of the schedule, including all
+// repositories of the schedule projects.
+func (schedules *Schedules) getRepositories(schedule Schedule) []string {
+	repositories := []string{}
+	for _, repository := range schedule.Repositories {
+		repositories = append(
+			repositories, strings.TrimSuffix(repository, "/"),
+		)
+	}
+
+	schedules.mutex.Lock()
+	stashAPI := schedules.stashAPI
+	schedules.mutex.Unlock()
+
+	for _, project := range schedule.Projects {
+		project = strings.TrimSuffix(project, "/")
+
+		key := reStashProjectURL.FindStringSubmatch(project)[1]
+
+		slugs, err := stashAPI.GetRepositories(key)
+		if err != nil {
+			schedules.logger.Errorf(
+				"can't obtain repositories of project %s: %s", key, err,
+			)
+			continue
+		}
+
+		for _, slug := range slugs {
+			repositories = append(repositories, project+"/repos/"+slug)
+		}
+	}
+
+	return repositories
+}
+
+// check looks for finished scheduled builds and notifies about builds which
+// failed when the previous scheduled build of the same branch passed.
+func (schedules *Schedules) check() {
+	schedules.mutex.Lock()
+	defer schedules.mutex.Unlock()
+
+	for id, build := range schedules.builds {
+		task := schedules.queue.GetTaskByUniqueID(int(id))
+		if task == nil {
+			delete(schedules.builds, id)
+			continue
+		}
+
+		state := task.GetState()
+		if !state.IsFinished() {
+			continue
+		}
+
+		delete(schedules.builds, id)
+
+		// cancelled build says nothing about the branch.
+		if state == TaskStateCancelled {
+			continue
+		}
+
+		previous := schedules.states[build.identifier]
+		schedules.states[build.identifier] = state
+
+		if previous == TaskStateSuccess && state != TaskStateSuccess {
+			schedules.notify(build, task)
+		}
+	}
+}
+
+func (schedules *Schedules) notify(build scheduledBuild, task Task) {
+	text := fmt.Sprintf(
+		"scheduled build of %s is broken: %s/status/%d",
+		build.identifier, schedules.basicURL, task.GetUniqueID(),
+	)
+
+	schedules.logger.Warning(text)
+
+	if build.notifyURL == "" {
+		return
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"text":       text,
+		"identifier": build.identifier,
+		"task":       task.GetUniqueID(),
+	})
+	if err != nil {
+		schedules.logger.Error(err)
+		return
+	}
+
+	go func() {
+		response, err := schedules.client.Post(
+			build.notifyURL, "application/json", bytes.NewReader(payload),
+		)
+		if err != nil {
+			schedules.logger.Errorf(
+				"can't send notification to %s: %s", build.notifyURL, err,
+			)
+			return
+		}
+
+		response.Body.Close()
+
+		if response.StatusCode >= 300 {
+			schedules.logger.Errorf(
+				"can't send notification to %s: %s",
+				build.notifyURL, response.Status,
+			)
+		}
+	}()
+}
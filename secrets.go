@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/kovetskiy/ko"
+	"github.com/reconquest/hierr-go"
+)
+
+const secretMask = "******"
+
+// secretMinimalLength is a minimal length of secret value, shorter values
+// match random parts of logs, so masking them makes logs unreadable and
+// reveals the value.
+const secretMinimalLength = 6
+
+var reSecretName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Secret is a variable which is passed to build commands of repositories in
+// the scope, but never shown in logs, comments and API output. Secrets are
+// configured in secrets section or in the separate file which has only
+// variables section:
+//
+//	[secrets]
+//	  file = "/etc/uroboros/secrets.conf"
+//	  [[secrets.variables]]
+//	    name = "DB_PASSWORD"
+//	    value = "hunter2"
+//	    scope = "git.local/prj/repo"
+//	    steps = ["test"]
+//
+// Scope is a host, host/project or host/project/repository, empty scope
+// matches all repositories. If file is true, value is written into file in
+// the workspace and the variable contains path of the file, the file exists
+// only during steps which the secret is passed to. Secret is passed to all
+// build steps if steps are not set.
+type Secret struct {
+	Name  string
+	Value string
+	Scope string
+	File  bool
+	Steps []string
+}
+
+type secretsFile struct {
+	Variables []Secret
+}
+
+// loadSecrets validates secrets from config and loads secrets from the
+// separate file.
+func loadSecrets(secrets []Secret, path string) ([]Secret, error) {
+	if path != "" {
+		var file secretsFile
+		err := ko.Load(path, &file)
+		if err != nil {
+			return nil, hierr.Errorf(err, "can't load secrets from %s", path)
+		}
+
+		secrets = append(secrets, file.Variables...)
+	}
+
+	for _, secret := range secrets {
+		if !reSecretName.MatchString(secret.Name) {
+			return nil, fmt.Errorf("invalid name of secret '%s'", secret.Name)
+		}
+
+		if len(secret.Value) < secretMinimalLength {
+			return nil, fmt.Errorf(
+				"secret %s is shorter than %d characters",
+				secret.Name, secretMinimalLength,
+			)
+		}
+
+		for _, step := range secret.Steps {
+			if !isKnownStep(step) {
+				return nil, fmt.Errorf(
+					"secret %s has unknown step '%s'", secret.Name, step,
+				)
+			}
+		}
+	}
+
+	return secrets, nil
+}
+
+// getSecrets returns secrets which scopes match the task repository.
+func (resources *resources) getSecrets(task Task) []Secret {
+	slug := strings.ToLower(getRepositorySlug(task))
+
+	secrets := []Secret{}
+	for _, secret := range resources.secrets {
+		scope := strings.ToLower(strings.Trim(secret.Scope, "/"))
+		if scope == "" || slug == scope || strings.HasPrefix(slug, scope+"/") {
+			secrets = append(secrets, secret)
+		}
+	}
+
+	return secrets
+}
+
+// isPassedTo returns true if the secret should be passed to commands of the
+// given step.
+func (secret Secret) isPassedTo(step string) bool {
+	if len(secret.Steps) == 0 {
+		return true
+	}
+
+	for _, name := range secret.Steps {
+		if name == step {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeSecretFiles writes values of file secrets which are passed to the
+// given step into the workspace, files of previous step are removed, so
+// commands of other steps can't read them. Returns variables which contain
+// paths of these files by names of secrets.
+func writeSecretFiles(
+	gopath string,
+	secrets []Secret,
+	step string,
+) (map[string]string, error) {
+	paths := map[string]string{}
+
+	// directory is created again, because commands of previous step could
+	// replace it with symlink.
+	directory := filepath.Join(gopath, ".secrets")
+
+	err := os.RemoveAll(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, secret := range secrets {
+		if !secret.File || !secret.isPassedTo(step) {
+			continue
+		}
+
+		if len(paths) == 0 {
+			err = os.Mkdir(directory, 0700)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		path := filepath.Join(directory, secret.Name)
+
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = file.WriteString(secret.Value)
+		if err == nil {
+			err = file.Close()
+		} else {
+			file.Close()
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		paths[secret.Name] = path
+	}
+
+	return paths, nil
+}
+
+// secretMasker replaces values of secrets with mask.
+type secretMasker struct {
+	replacer *strings.Replacer
+}
+
+func newSecretMasker(secrets []Secret) *secretMasker {
+	pairs := []string{}
+	for _, secret := range secrets {
+		pairs = append(pairs, secret.Value, secretMask)
+
+		// multiline secrets like keys are usually printed without trailing
+		// newline or with newlines converted by terminal.
+		trimmed := strings.TrimSpace(secret.Value)
+		if trimmed != secret.Value && len(trimmed) >= secretMinimalLength {
+			pairs = append(pairs, trimmed, secretMask)
+		}
+
+		if strings.Contains(trimmed, "\n") {
+			pairs = append(
+				pairs,
+				strings.Replace(trimmed, "\n", "\r\n", -1), secretMask,
+			)
+		}
+	}
+
+	return &secretMasker{replacer: strings.NewReplacer(pairs...)}
+}
+
+func (masker *secretMasker) Mask(value string) string {
+	if masker == nil {
+		return value
+	}
+
+	return masker.replacer.Replace(value)
+}
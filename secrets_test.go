@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoadSecrets_RejectsShortValues(t *testing.T) {
+	_, err := loadSecrets([]Secret{{Name: "PIN", Value: "1234"}}, "")
+	if err == nil {
+		t.Fatal("short secret is accepted")
+	}
+
+	_, err = loadSecrets([]Secret{{Name: "TOKEN", Value: "hunter2"}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSecretMasker_MasksMultilineValueAsWhole(t *testing.T) {
+	key := "-----BEGIN KEY-----\nc2VjcmV0\nend\n-----END KEY-----\n"
+
+	masker := newSecretMasker([]Secret{{Name: "KEY", Value: key}})
+
+	tests := map[string]string{
+		"key: " + key + "done":                       "key: " + secretMask + "done",
+		"key: " + strings.TrimSpace(key) + " done":   "key: " + secretMask + " done",
+		strings.Replace(key, "\n", "\r\n", -1):       secretMask + "\r\n",
+		"-----BEGIN KEY-----\nsome other key\nend\n": "-----BEGIN KEY-----\nsome other key\nend\n",
+	}
+
+	for output, expected := range tests {
+		if masked := masker.Mask(output); masked != expected {
+			t.Errorf("Mask(%q) = %q, expected %q", output, masked, expected)
+		}
+	}
+}
+
+func TestWriteSecretFiles_WritesOnlySecretsOfStep(t *testing.T) {
+	var (
+		gopath  = t.TempDir()
+		secrets = []Secret{
+			{
+				Name:  "TEST_KEY",
+				Value: "test-secret",
+				File:  true,
+				Steps: []string{stepTest},
+			},
+			{Name: "ANY_KEY", Value: "any-secret", File: true},
+		}
+	)
+
+	paths, err := writeSecretFiles(gopath, secrets, stepTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testKey := paths["TEST_KEY"]
+
+	contents, err := ioutil.ReadFile(testKey)
+	if err != nil || string(contents) != "test-secret" {
+		t.Fatalf("secret of test step is not written: %q, %v", contents, err)
+	}
+
+	paths, err = writeSecretFiles(gopath, secrets, stepBuild)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := paths["TEST_KEY"]; ok {
+		t.Fatal("secret of test step is passed to build step")
+	}
+
+	if _, err := os.Stat(testKey); !os.IsNotExist(err) {
+		t.Fatalf("secret of test step is readable during build step: %v", err)
+	}
+
+	if _, ok := paths["ANY_KEY"]; !ok {
+		t.Fatal("secret of all steps is not passed to build step")
+	}
+}
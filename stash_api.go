@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/reconquest/hierr-go"
+)
+
+// StashAPI implements Stash REST API methods which are not provided by
+// the stash package.
+type StashAPI struct {
+	address  *url.URL
+	username string
+	password string
+	client   *http.Client
+}
+
+type StashCommentAnchor struct {
+	Path     string `json:"path"`
+	Line     int    `json:"line,omitempty"`
+	LineType string `json:"lineType,omitempty"`
+	FileType string `json:"fileType,omitempty"`
+}
+
+type StashComment struct {
+	ID     int                 `json:"id,omitempty"`
+	Text   string              `json:"text"`
+	Anchor *StashCommentAnchor `json:"anchor,omitempty"`
+}
+
+type stashActivity struct {
+	Action        string              `json:"action"`
+	Comment       StashComment        `json:"comment"`
+	CommentAnchor *StashCommentAnchor `json:"commentAnchor"`
+}
+
+type stashPage struct {
+	IsLastPage    bool            `json:"isLastPage"`
+	NextPageStart int             `json:"nextPageStart"`
+	Values        json.RawMessage `json:"values"`
+}
+
+func NewStashAPI(address *url.URL, username, password string) *StashAPI {
+	return &StashAPI{
+		address:  address,
+		username: username,
+		password: password,
+		client:   &http.Client{Timeout: time.Minute},
+	}
+}
+
+func (api *StashAPI) getPullRequestPath(
+	project, repository, identifier string,
+) string {
+	return fmt.Sprintf(
+		"/rest/api/1.0/projects/%s/repos/%s/pull-requests/%s",
+		project, repository, identifier,
+	)
+}
+
+// CreateComment creates comment in the pull request, comment will be attached
+// to the file line if anchor is specified.
+func (api *StashAPI) CreateComment(
+	project, repository, identifier string,
+	comment StashComment,
+) (StashComment, error) {
+	var created StashComment
+	err := api.request(
+		"POST",
+		api.getPullRequestPath(project, repository, identifier)+"/comments",
+		comment,
+		&created,
+	)
+
+	return created, err
+}
+
+// GetLineComments returns all comments attached to lines of files of the
+// pull request.
+func (api *StashAPI) GetLineComments(
+	project, repository, identifier string,
+) ([]StashComment, error) {
+	comments, err := api.GetComments(project, repository, identifier)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []StashComment{}
+	for _, comment := range comments {
+		if comment.Anchor != nil {
+			lines = append(lines, comment)
+		}
+	}
+
+	return lines, nil
+}
+
+// GetComments returns all comments of the pull request, comments on lines of
+// files have anchor.
+func (api *StashAPI) GetComments(
+	project, repository, identifier string,
+) ([]StashComment, error) {
+	comments := []StashComment{}
+
+	start := 0
+	for {
+		var page stashPage
+		err := api.request(
+			"GET",
+			fmt.Sprintf(
+				"%s/activities?limit=500&start=%d",
+				api.getPullRequestPath(project, repository, identifier),
+				start,
+			),
+			nil,
+			&page,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		var activities []stashActivity
+		err = json.Unmarshal(page.Values, &activities)
+		if err != nil {
+			return nil, hierr.Errorf(
+				err, "can't decode pull request activities",
+			)
+		}
+
+		for _, activity := range activities {
+			if activity.Action != "COMMENTED" {
+				continue
+			}
+
+			comment := activity.Comment
+			comment.Anchor = activity.CommentAnchor
+
+			comments = append(comments, comment)
+		}
+
+		if page.IsLastPage {
+			return comments, nil
+		}
+
+		start = page.NextPageStart
+	}
+}
+
+// GetBranchHead returns hash of the head commit of the repository branch.
+func (api *StashAPI) GetBranchHead(
+	project, repository, branch string,
+) (string, error) {
+	var page stashPage
+	err := api.request(
+		"GET",
+		fmt.Sprintf(
+			"/rest/api/1.0/projects/%s/repos/%s/commits?until=%s&limit=1",
+			project, repository, url.QueryEscape("refs/heads/"+branch),
+		),
+		nil,
+		&page,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	var commits []struct {
+		ID string `json:"id"`
+	}
+
+	err = json.Unmarshal(page.Values, &commits)
+	if err != nil {
+		return "", hierr.Errorf(err, "can't decode commits")
+	}
+
+	if len(commits) == 0 {
+		return "", fmt.Errorf("branch %s has no commits", branch)
+	}
+
+	return commits[0].ID, nil
+}
+
+// GetRepositories returns slugs of all repositories of the project.
+func (api *StashAPI) GetRepositories(project string) ([]string, error) {
+	slugs := []string{}
+
+	start := 0
+	for {
+		var page stashPage
+		err := api.request(
+			"GET",
+			fmt.Sprintf(
+				"/rest/api/1.0/projects/%s/repos?limit=500&start=%d",
+				project, start,
+			),
+			nil,
+			&page,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		var repositories []struct {
+			Slug string `json:"slug"`
+		}
+
+		err = json.Unmarshal(page.Values, &repositories)
+		if err != nil {
+			return nil, hierr.Errorf(err, "can't decode repositories")
+		}
+
+		for _, repository := range repositories {
+			slugs = append(slugs, repository.Slug)
+		}
+
+		if page.IsLastPage {
+			return slugs, nil
+		}
+
+		start = page.NextPageStart
+	}
+}
+
+func (api *StashAPI) request(
+	method string,
+	path string,
+	payload interface{},
+	result interface{},
+) error {
+	var body []byte
+	if payload != nil {
+		var err error
+		body, err = json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+	}
+
+	request, err := http.NewRequest(
+		method,
+		strings.TrimSuffix(api.address.String(), "/")+path,
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+
+	request.SetBasicAuth(api.username, api.password)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Accept", "application/json")
+
+	response, err := api.client.Do(request)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	contents, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf(
+			"%s %s: %s: %s",
+			method, path, response.Status, strings.TrimSpace(string(contents)),
+		)
+	}
+
+	if result == nil || len(contents) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(contents, result)
+}
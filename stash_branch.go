@@ -0,0 +1,30 @@
+package main
+
+type ProcessorStashBranch struct {
+	stashBuilder
+
+	task *TaskStashBranch
+}
+
+func NewProcessorStashBranch(task *TaskStashBranch) *ProcessorStashBranch {
+	return &ProcessorStashBranch{
+		stashBuilder: stashBuilder{task: task, branch: task.Branch},
+		task:         task,
+	}
+}
+
+func (processor *ProcessorStashBranch) Process() {
+	processor.task.SetState(TaskStateProcessing)
+
+	processor.logger.Infof(":: building branch %s", processor.branch)
+
+	err := processor.process()
+	if err != nil {
+		processor.logger.Error(err)
+		processor.task.SetState(processor.getFailureState())
+		return
+	}
+
+	processor.logger.Infof(":: build passing")
+	processor.task.SetState(TaskStateSuccess)
+}
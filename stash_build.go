@@ -0,0 +1,1180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/reconquest/executil-go"
+	"github.com/reconquest/hierr-go"
+)
+
+// stashBuilder implements build steps which are shared by processors of
+// Stash tasks: fetching, building, linting, testing and measuring coverage of
+// the repository branch.
+type stashBuilder struct {
+	processor
+
+	task Task
+
+	// branch is a branch which is built, target is a branch which the build
+	// is compared with, target is empty if there is nothing to compare with.
+	branch string
+	target string
+
+	// step is a name of the currently running build step.
+	step string
+
+	// untrusted is true if sources of the build come from untrusted source,
+	// like fork or unknown author, such builds are run only after approval
+	// and under restrictions of policy.
+	untrusted bool
+
+	quota *taskQuota
+
+	// ctx is done when the task is cancelled or its timeout is exceeded.
+	ctx context.Context
+
+	// environment is an environment of build commands, it's nil until the
+	// workspace is prepared.
+	environment []string
+
+	// sourcesEnvironment is an environment of commands which fetch sources
+	// and dependencies.
+	sourcesEnvironment []string
+
+	// cache is a directory of Go build cache of the repository.
+	cache string
+
+	// secrets are passed to build commands, secretFiles are paths of files
+	// with values of file secrets by names of secrets.
+	secrets     []Secret
+	secretFiles map[string]string
+	masker      *secretMasker
+
+	gopath      string
+	sources     string
+	diff        *lintDiff
+	lintSummary []string
+	makefile    struct {
+		build bool
+		test  bool
+	}
+}
+
+func (builder *stashBuilder) process() error {
+	builder.ctx = builder.task.GetContext()
+	if timeout := builder.resources.taskTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		builder.ctx, cancel = context.WithTimeout(builder.ctx, timeout)
+		defer cancel()
+	}
+
+	defer func() {
+		if builder.gopath != "" {
+			builder.logger.Debugf("removing directory %s", builder.gopath)
+
+			err := os.RemoveAll(builder.gopath)
+			if err != nil {
+				builder.logger.Errorf(
+					"can't remove directory %s: %s", builder.gopath, err,
+				)
+			}
+		}
+	}()
+
+	quota, err := builder.resources.newTaskQuota(builder.task)
+	if err != nil {
+		return hierr.Errorf(err, "can't apply quota to task")
+	}
+
+	builder.quota = quota
+
+	builder.secrets = builder.resources.getSecrets(builder.task)
+	builder.masker = newSecretMasker(builder.secrets)
+
+	if builder.untrusted && !builder.resources.config.Policy.Secrets {
+		builder.secrets = nil
+	}
+
+	defer func() {
+		usage := builder.quota.release(builder.gopath)
+		builder.task.SetResourceUsage(&usage)
+
+		builder.logger.Infof("resource usage: %s", usage)
+	}()
+
+	builder.step = stepFetch
+
+	err = builder.fetch()
+	if err != nil {
+		return err
+	}
+
+	builder.logger.Infof(":: successfully fetched")
+
+	err = builder.lookupMakefileTargets()
+	if err != nil {
+		return err
+	}
+
+	err = builder.setStep(stepBuild)
+	if err != nil {
+		return err
+	}
+
+	err = builder.build()
+	if err != nil {
+		return err
+	}
+
+	builder.logger.Infof(":: successfully built")
+
+	err = builder.setStep(stepLint)
+	if err != nil {
+		return err
+	}
+
+	err = builder.lint()
+	if err != nil {
+		return err
+	}
+
+	builder.logger.Infof(":: successfully linted")
+
+	err = builder.setStep(stepTest)
+	if err != nil {
+		return err
+	}
+
+	err = builder.test()
+	if err != nil {
+		return err
+	}
+
+	builder.logger.Infof(":: successfully tested")
+
+	if builder.resources.config.Resources.Coverage.Enabled {
+		err = builder.setStep(stepCoverage)
+		if err != nil {
+			return err
+		}
+
+		err = builder.coverage()
+		if err != nil {
+			return err
+		}
+
+		builder.logger.Infof(":: successfully checked coverage")
+	}
+
+	return nil
+}
+
+// setStep switches the build to the given step, file secrets of the
+// previous step are removed and file secrets of the given step are written.
+func (builder *stashBuilder) setStep(step string) error {
+	builder.step = step
+
+	if builder.gopath == "" {
+		return nil
+	}
+
+	var err error
+	builder.secretFiles, err = writeSecretFiles(
+		builder.gopath, builder.secrets, step,
+	)
+	if err != nil {
+		return hierr.Errorf(err, "can't write secret files")
+	}
+
+	return nil
+}
+
+// getFailureState returns state of the task which build is failed, build is
+// failed either by itself, by timeout or because the task is cancelled.
+func (builder *stashBuilder) getFailureState() TaskState {
+	switch {
+	case builder.task.GetContext().Err() != nil:
+		builder.logger.Warning(":: build is cancelled")
+		return TaskStateCancelled
+
+	case builder.ctx != nil && builder.ctx.Err() == context.DeadlineExceeded:
+		builder.logger.Errorf(
+			":: build is timed out after %s", builder.resources.taskTimeout,
+		)
+		return TaskStateTimedOut
+
+	default:
+		return TaskStateError
+	}
+}
+
+// getContext returns context of build commands.
+func (builder *stashBuilder) getContext() context.Context {
+	if builder.ctx == nil {
+		return context.Background()
+	}
+
+	return builder.ctx
+}
+
+type lintResult struct {
+	findings []LintFinding
+	exited   bool
+	timeout  bool
+}
+
+func (builder *stashBuilder) lint() error {
+	var (
+		failures = []string{}
+		findings = []LintFinding{}
+		mode     = builder.resources.config.Resources.Lint.Mode
+		results  map[string]lintResult
+		baseline map[string][]LintFinding
+		err      error
+	)
+
+	if builder.target == "" {
+		mode = lintModeAll
+	} else {
+		err = builder.fetchDiff()
+		if err != nil {
+			if mode == lintModeDiff {
+				return err
+			}
+
+			builder.logger.Warning(err)
+		}
+	}
+
+	builder.logger.Infof(
+		":: linting source code using %s",
+		strings.Join(getLinterNames(builder.resources.linters), ", "),
+	)
+
+	results, err = builder.runLinters(builder.resources.linters)
+	if err != nil {
+		return err
+	}
+
+	if mode == lintModeBaseline {
+		baseline, err = builder.getLintBaseline()
+		if err != nil {
+			return err
+		}
+	}
+
+	builder.lintSummary = []string{}
+
+	for _, linter := range getLinterNames(builder.resources.linters) {
+		var (
+			result   = results[linter]
+			found    = result.findings
+			severity = builder.resources.linters[linter].Severity
+		)
+
+		builder.logger.Infof(":: %s", linter)
+
+		switch mode {
+		case lintModeDiff:
+			for i, finding := range found {
+				if !builder.diff.IsChanged(finding) {
+					found[i].Informational = true
+				}
+			}
+
+		case lintModeBaseline:
+			created, fixed := compareLintFindings(found, baseline[linter])
+
+			summary := fmt.Sprintf(
+				"%s: %d new, %d fixed", linter, created, fixed,
+			)
+
+			builder.logger.Infof(":: %s", summary)
+			builder.lintSummary = append(builder.lintSummary, summary)
+		}
+
+		blocking := 0
+		for _, finding := range found {
+			switch {
+			case finding.Informational:
+				builder.logger.Infof("(not blocking) %s", finding)
+
+			case severity == lintSeverityWarning:
+				builder.logger.Warning(finding.String())
+
+			default:
+				builder.logger.Error(finding.String())
+				blocking++
+			}
+		}
+
+		// non-zero exit code of linter is caused by its findings if there are
+		// any, otherwise linter failed by itself.
+		failed := blocking > 0
+		if result.exited &&
+			(mode == lintModeAll || !hasLocatedFindings(found)) {
+			failed = true
+		}
+
+		if result.timeout {
+			builder.logger.Warningf(
+				"linter %s is killed by timeout %s",
+				linter, builder.resources.linters[linter].Timeout,
+			)
+
+			failed = true
+		}
+
+		if failed && severity == lintSeverityWarning {
+			builder.logger.Warningf(
+				"linter %s failed, but it has warning severity", linter,
+			)
+
+			failed = false
+		}
+
+		if failed {
+			failures = append(failures, linter)
+		}
+
+		findings = append(findings, found...)
+	}
+
+	builder.task.SetLintFindings(findings)
+
+	if len(failures) > 0 {
+		subject := "linter"
+		if len(failures) > 1 {
+			subject = "linters"
+		}
+
+		return fmt.Errorf(
+			"%s %s reported issues or exited with non-zero exit code",
+			subject, strings.Join(failures, ", "),
+		)
+	}
+
+	return nil
+}
+
+// hasLocatedFindings returns true if any finding points to a file.
+func hasLocatedFindings(findings []LintFinding) bool {
+	for _, finding := range findings {
+		if finding.File != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runLinters runs given linters concurrently, amount of simultaneously
+// running linters is limited by resources.lint.concurrency.
+func (builder *stashBuilder) runLinters(
+	linters map[string]Linter,
+) (map[string]lintResult, error) {
+	var (
+		results   = map[string]lintResult{}
+		errs      = []error{}
+		mutex     = &sync.Mutex{}
+		waiter    = &sync.WaitGroup{}
+		semaphore = make(
+			chan struct{}, builder.resources.config.Resources.Lint.Concurrency,
+		)
+	)
+
+	for _, name := range getLinterNames(linters) {
+		waiter.Add(1)
+
+		go func(name string) {
+			defer waiter.Done()
+
+			semaphore <- struct{}{}
+			defer func() {
+				<-semaphore
+			}()
+
+			result, err := builder.runLinter(linters[name])
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+
+			results[name] = result
+		}(name)
+	}
+
+	waiter.Wait()
+
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+
+	return results, nil
+}
+
+func (builder *stashBuilder) runLinter(
+	linter Linter,
+) (lintResult, error) {
+	ctx := builder.getContext()
+	if linter.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, linter.Timeout)
+		defer cancel()
+	}
+
+	stdout, stderr, err := builder.spawnContext(
+		ctx, linter.Dir, "sh", "-c", linter.Command,
+	)
+	if err != nil && !executil.IsExitError(err) {
+		return lintResult{}, hierr.Errorf(
+			err,
+			"an error occurred while linting source code",
+		)
+	}
+
+	return lintResult{
+		findings: parseLintOutput(linter, stdout+stderr, builder.sources),
+		exited:   err != nil,
+		timeout:  ctx.Err() == context.DeadlineExceeded,
+	}, nil
+}
+
+// getLintBaseline returns findings of linters for the head of the target
+// branch, results are cached by commit, so linters run on the target branch
+// only once per commit. Target branch is fetched into the separate
+// workspace, because build commands can modify repository of the build.
+func (builder *stashBuilder) getLintBaseline() (
+	map[string][]LintFinding, error,
+) {
+	url, err := builder.getCloneURL()
+	if err != nil {
+		return nil, hierr.Errorf(err, "can't obtain repository clone URL")
+	}
+
+	baseline := *builder
+	baseline.gopath = ""
+	baseline.sources = ""
+	baseline.step = stepFetch
+
+	gopath, err := baseline.createWorkspace()
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.RemoveAll(gopath)
+
+	output, stderr, err := baseline.spawnEnvironment(
+		baseline.getContext(), "", baseline.sourcesEnvironment,
+		"git", "ls-remote", url, "refs/heads/"+builder.target,
+	)
+	if err != nil {
+		return nil, hierr.Errorf(
+			hierr.Errorf(err, stderr),
+			"can't obtain head commit of target branch",
+		)
+	}
+
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("target branch %s is not found", builder.target)
+	}
+
+	var (
+		commit     = fields[0]
+		repository = getRepositorySlug(builder.task)
+		findings   = map[string][]LintFinding{}
+		missing    = map[string]Linter{}
+	)
+
+	for name, linter := range builder.resources.linters {
+		cached, ok := getCachedLintBaseline(repository, commit, linter)
+		if ok {
+			findings[name] = cached
+		} else {
+			missing[name] = linter
+		}
+	}
+
+	if len(missing) == 0 {
+		return findings, nil
+	}
+
+	builder.logger.Infof(
+		":: linting target branch %s at %s",
+		builder.target, commit,
+	)
+
+	err = baseline.cloneWorkspace(gopath, url, builder.target, commit)
+	if err != nil {
+		return nil, hierr.Errorf(err, "can't fetch target branch")
+	}
+
+	baseline.step = stepLint
+
+	results, err := baseline.runLinters(missing)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, result := range results {
+		findings[name] = result.findings
+
+		setCachedLintBaseline(
+			repository, commit, missing[name], result.findings,
+		)
+	}
+
+	return findings, nil
+}
+
+// fetchDiff obtains lines changed by the built branch comparing to the target
+// branch.
+func (builder *stashBuilder) fetchDiff() error {
+	output, stderr, err := builder.spawnOutput(
+		"git", "diff", "-U0", "--no-color", "--no-ext-diff",
+		"origin/"+builder.target+"...HEAD",
+	)
+	if err != nil {
+		return hierr.Errorf(
+			hierr.Errorf(err, stderr),
+			"can't obtain changes comparing to %s", builder.target,
+		)
+	}
+
+	builder.diff = parseDiff(output)
+
+	return nil
+}
+
+func (builder *stashBuilder) build() error {
+	var stderr string
+	var err error
+	if builder.makefile.build {
+		builder.logger.Infof(":: building project using make build")
+
+		stderr, err = builder.makeBuild()
+	} else {
+		builder.logger.Infof(":: building project using go build")
+
+		stderr, err = builder.gobuild()
+	}
+
+	if err != nil {
+		if executil.IsExitError(err) {
+			output := strings.Split(stderr, "\n")
+			for _, line := range output {
+				builder.logger.Error(line)
+			}
+
+			if builder.makefile.build {
+				return errors.New("make build exited with non-zero exit code")
+			} else {
+				return errors.New("go build exited with non-zero exit code")
+			}
+		}
+
+		return hierr.Errorf(
+			err,
+			"can't build project",
+		)
+	}
+
+	return nil
+}
+
+func (builder *stashBuilder) test() error {
+	var stderr string
+	var err error
+	if builder.makefile.test {
+		builder.logger.Infof(":: testing project using make test")
+
+		stderr, err = builder.makeTest()
+	} else {
+		builder.logger.Infof(":: testing project using go test")
+
+		stderr, err = builder.gotest()
+	}
+
+	if err != nil {
+		if executil.IsExitError(err) {
+			output := strings.Split(stderr, "\n")
+			for _, line := range output {
+				builder.logger.Error(line)
+			}
+
+			builder.reportFailedTests()
+
+			if builder.makefile.test {
+				return errors.New("make test exited with non-zero exit code")
+			} else {
+				return errors.New("go test exited with non-zero exit code")
+			}
+		}
+
+		return hierr.Errorf(
+			err,
+			"can't test project",
+		)
+	}
+
+	return nil
+}
+
+func (builder *stashBuilder) reportFailedTests() {
+	report := builder.task.GetTestReport()
+	if report == nil {
+		return
+	}
+
+	for _, pkg := range report.Packages {
+		found := false
+		for _, test := range pkg.Tests {
+			if test.Result != testResultFail {
+				continue
+			}
+
+			found = true
+
+			for _, line := range strings.Split(
+				strings.TrimRight(test.Output, "\n"), "\n",
+			) {
+				builder.logger.Error(line)
+			}
+		}
+
+		if !found && pkg.Result == testResultFail {
+			for _, line := range strings.Split(
+				strings.TrimRight(pkg.Output, "\n"), "\n",
+			) {
+				builder.logger.Error(line)
+			}
+		}
+	}
+}
+
+// coverage calculates coverage of the tests and compares it with coverage of
+// the latest successful build of the target branch. Coverage includes all
+// packages of the repository (-coverpkg=./...), if project is tested by make
+// test, tests of all packages are run again to collect it.
+func (builder *stashBuilder) coverage() error {
+	var (
+		config  = builder.resources.config.Resources.Coverage
+		profile = builder.getCoverProfilePath()
+		target  = builder.target
+	)
+
+	if builder.makefile.test {
+		builder.logger.Infof(":: collecting coverage using go test")
+
+		args := []string{"test", "-gcflags", "-e"}
+		args = append(args, builder.getCoverArgs()...)
+		args = append(args, "./...")
+
+		_, stderr, err := builder.spawnOutput("go", args...)
+		if err != nil {
+			return hierr.Errorf(
+				hierr.Errorf(err, stderr),
+				"can't collect coverage",
+			)
+		}
+	}
+
+	contents, err := ioutil.ReadFile(profile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			builder.logger.Warningf(
+				"no coverage profile written, project has no tests",
+			)
+			return nil
+		}
+
+		return hierr.Errorf(err, "can't read coverage profile")
+	}
+
+	report, err := parseCoverProfile(string(contents))
+	if err != nil {
+		return err
+	}
+
+	commit, stderr, err := builder.spawnOutput("git", "rev-parse", "HEAD")
+	if err != nil {
+		return hierr.Errorf(
+			hierr.Errorf(err, stderr),
+			"can't obtain head commit",
+		)
+	}
+
+	report.Branch = builder.branch
+	report.Commit = strings.TrimSpace(commit)
+
+	if target != "" {
+		previous := builder.resources.coverage.GetLatest(
+			getRepositorySlug(builder.task), target,
+		)
+		if previous != nil {
+			report.Compare(previous)
+		} else {
+			builder.logger.Infof(
+				":: target branch %s has no coverage yet", target,
+			)
+		}
+	}
+
+	builder.task.SetCoverage(report)
+
+	builder.logger.Infof(":: coverage: %s", report)
+
+	for _, pkg := range report.Packages {
+		if pkg.Delta != nil && *pkg.Delta < 0 {
+			builder.logger.Warningf(
+				"coverage of %s decreased: %.1f%% (%+.1f%%)",
+				pkg.Name, pkg.Coverage, *pkg.Delta,
+			)
+		}
+	}
+
+	if config.Minimum > 0 && report.Coverage < config.Minimum {
+		return fmt.Errorf(
+			"coverage %.1f%% is below minimum %.1f%%",
+			report.Coverage, config.Minimum,
+		)
+	}
+
+	if config.NoDecrease && report.Delta != nil && *report.Delta < 0 {
+		return fmt.Errorf(
+			"coverage decreased by %.1f%% comparing to %s",
+			-*report.Delta, target,
+		)
+	}
+
+	return nil
+}
+
+func (builder *stashBuilder) getCoverProfilePath() string {
+	return filepath.Join(builder.gopath, "coverage.out")
+}
+
+// getCoverArgs returns go test flags which write coverage profile of all
+// packages of the repository, not only of the tested package.
+func (builder *stashBuilder) getCoverArgs() []string {
+	return []string{
+		"-coverpkg=./...", "-coverprofile", builder.getCoverProfilePath(),
+	}
+}
+
+func (builder *stashBuilder) lookupMakefileTargets() error {
+	contents, err := ioutil.ReadFile(
+		filepath.Join(builder.sources, "Makefile"),
+	)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return hierr.Errorf(
+			err,
+			"can't read Makefile",
+		)
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		if strings.HasPrefix(line, "build:") {
+			builder.makefile.build = true
+		}
+
+		if strings.HasPrefix(line, "test:") {
+			builder.makefile.test = true
+		}
+
+		if builder.makefile.build && builder.makefile.test {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (builder *stashBuilder) fetch() error {
+	var branch = builder.branch
+
+	builder.logger.Infof(
+		":: retrieving information about repository",
+	)
+
+	cloneURL, err := builder.getCloneURL()
+	if err != nil {
+		return hierr.Errorf(
+			err,
+			"can't obtain repository clone URL",
+		)
+	}
+
+	builder.logger.Infof(
+		":: cloning repository %s", cloneURL,
+	)
+
+	err = builder.prepareSources(cloneURL, branch)
+	if err != nil {
+		return hierr.Errorf(
+			err,
+			"can't clone repository %s", cloneURL,
+		)
+	}
+
+	builder.logger.Infof(
+		":: fetching project's dependencies",
+	)
+
+	stderr, err := builder.goget()
+	if err != nil {
+		if executil.IsExitError(err) {
+			output := strings.Split(stderr, "\n")
+			for _, line := range output {
+				builder.logger.Error(line)
+			}
+
+			return errors.New("go get exited with non-zero exit code")
+		}
+
+		return hierr.Errorf(
+			err,
+			"can't fetch project's dependencies",
+		)
+	}
+
+	return nil
+}
+
+func (builder *stashBuilder) getCloneURL() (string, error) {
+	url := cache.Get(
+		builder.task.GetHost(),
+		builder.task.GetProject(),
+		builder.task.GetRepository(),
+	)
+	if url != "" {
+		return url, nil
+	}
+
+	repository, err := builder.resources.stash.GetRepository(
+		builder.task.GetProject(),
+		builder.task.GetRepository(),
+	)
+	if err != nil {
+		return "", hierr.Errorf(
+			err,
+			"can't obtain information about specified repository",
+		)
+	}
+
+	cache.Set(
+		repository.SshUrl(),
+		builder.task.GetHost(),
+		builder.task.GetProject(),
+		builder.task.GetRepository(),
+	)
+
+	return repository.SshUrl(), nil
+}
+
+func (builder *stashBuilder) prepareSources(
+	url, branch string,
+) error {
+	builder.quota.watchCache(
+		builder.resources.getBuildCache(builder.task, builder.untrusted),
+	)
+
+	// branch can be updated after the build is approved or queued, so
+	// exactly the recorded commit is built.
+	err := builder.prepareWorkspace(url, branch, builder.task.GetCommit())
+	if err != nil {
+		return err
+	}
+
+	builder.task.SetEnvironment(getRecordedEnvironment(builder.environment))
+
+	return builder.setStep(builder.step)
+}
+
+// prepareWorkspace creates new workspace, clones the repository into it,
+// checks out the branch and resets it to the commit if it's not empty.
+func (builder *stashBuilder) prepareWorkspace(
+	url, branch, commit string,
+) error {
+	gopath, err := builder.createWorkspace()
+	if err != nil {
+		return err
+	}
+
+	err = builder.cloneWorkspace(gopath, url, branch, commit)
+	if err != nil && builder.gopath == "" {
+		os.RemoveAll(gopath)
+	}
+
+	return err
+}
+
+// createWorkspace creates directory of new workspace and prepares its
+// environment, returns path of the workspace.
+func (builder *stashBuilder) createWorkspace() (string, error) {
+	gopath, err := ioutil.TempDir(os.TempDir(), "uroboros_")
+	if err != nil {
+		return "", hierr.Errorf(
+			err, "can't create temporary directory",
+		)
+	}
+
+	builder.cache = builder.resources.getBuildCache(
+		builder.task, builder.untrusted,
+	)
+
+	environment, err := builder.resources.getEnvironment(gopath, builder.cache)
+	if err != nil {
+		os.RemoveAll(gopath)
+		return "", hierr.Errorf(err, "can't prepare environment of build")
+	}
+
+	builder.environment = environment
+	builder.sourcesEnvironment = getSourcesEnvironment(environment)
+
+	return gopath, nil
+}
+
+// cloneWorkspace clones the repository into the workspace created by
+// createWorkspace, checks out the branch and resets it to the commit if it's
+// not empty.
+func (builder *stashBuilder) cloneWorkspace(
+	gopath, url, branch, commit string,
+) error {
+	sources := filepath.Join(
+		gopath, "src",
+		builder.task.GetHost(), builder.task.GetProject(), builder.task.GetRepository(),
+	)
+
+	_, err := builder.spawnSources("git", "clone", url, sources)
+	if err != nil {
+		return err
+	}
+
+	builder.gopath = gopath
+	builder.sources = sources
+
+	builder.logger.Infof(
+		":: switching to branch %s", branch,
+	)
+
+	_, err = builder.spawnSources("git", "checkout", branch)
+	if err != nil {
+		return err
+	}
+
+	if commit != "" {
+		builder.logger.Infof(":: resetting branch to commit %s", commit)
+
+		_, err = builder.spawnSources("git", "reset", "--hard", commit)
+		if err != nil {
+			return hierr.Errorf(err, "can't reset branch to %s", commit)
+		}
+	}
+
+	_, err = builder.spawnSources(
+		"git", "submodule", "update", "--recursive", "--init",
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (builder *stashBuilder) goget() (string, error) {
+	return builder.spawnSources("go", "get", "-v", "-t", "-d")
+}
+
+func (builder *stashBuilder) gobuild() (string, error) {
+	return builder.spawn("go", "build", "-gcflags", "-e")
+}
+
+func (builder *stashBuilder) gotest() (string, error) {
+	args := []string{"test", "-json", "-gcflags", "-e"}
+	if builder.resources.config.Resources.Coverage.Enabled {
+		args = append(args, builder.getCoverArgs()...)
+	}
+
+	stdout, stderr, err := builder.spawnOutput("go", args...)
+
+	report := parseTestEvents(stdout)
+
+	passed, failed, skipped := report.GetCounts()
+	builder.logger.Infof(
+		":: tests: %d passed, %d failed, %d skipped", passed, failed, skipped,
+	)
+
+	builder.task.SetTestReport(report)
+
+	return stderr, err
+}
+
+func (builder *stashBuilder) makeBuild() (string, error) {
+	return builder.spawn("make", "build")
+}
+
+func (builder *stashBuilder) makeTest() (string, error) {
+	return builder.spawn("make", "test")
+}
+
+func (builder *stashBuilder) spawn(
+	name string, arg ...string,
+) (string, error) {
+	_, stderr, err := builder.spawnOutput(name, arg...)
+	return stderr, err
+}
+
+func (builder *stashBuilder) spawnOutput(
+	name string, arg ...string,
+) (string, string, error) {
+	return builder.spawnContext(builder.getContext(), "", name, arg...)
+}
+
+// spawnSources runs command which fetches sources or dependencies, it gets
+// environment of uroboros instead of environment of build commands.
+func (builder *stashBuilder) spawnSources(
+	name string, arg ...string,
+) (string, error) {
+	_, stderr, err := builder.spawnEnvironment(
+		builder.getContext(), "", builder.sourcesEnvironment, name, arg...,
+	)
+
+	return stderr, err
+}
+
+// spawnContext runs build command in the given directory relative to the
+// sources directory, the command is killed when context is done. Build
+// commands get only the prepared environment.
+func (builder *stashBuilder) spawnContext(
+	ctx context.Context, dir string, name string, arg ...string,
+) (string, string, error) {
+	var environment []string
+	if builder.environment != nil {
+		environment = builder.getStepEnvironment()
+	}
+
+	return builder.spawnEnvironment(ctx, dir, environment, name, arg...)
+}
+
+// spawnEnvironment runs command with the given environment, environment of
+// uroboros is used if it's nil. Commands which are run after sources are
+// cloned are sandboxed if sandbox is enabled for the
+// repository and are run without network if it's disabled for the current
+// step, all commands are run within quota of the task.
+func (builder *stashBuilder) spawnEnvironment(
+	ctx context.Context,
+	dir string,
+	environment []string,
+	name string,
+	arg ...string,
+) (string, string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, name, arg...)
+
+	if builder.sources != "" {
+		cmd.Dir = filepath.Join(builder.sources, dir)
+	}
+
+	network := true
+
+	cmd.Env = environment
+
+	if builder.gopath != "" {
+		spec, sandboxed := builder.resources.getSandbox(
+			builder.task, builder.untrusted,
+		)
+
+		network = builder.resources.isNetworkEnabled(builder.step)
+
+		// dependencies are fetched with network, policy restricts only
+		// commands which run code of the untrusted build.
+		if policy := builder.resources.config.Policy; builder.untrusted &&
+			builder.step != stepFetch &&
+			policy.Network != nil && !*policy.Network {
+			network = false
+		}
+
+		if sandboxed {
+			spec.Root = filepath.Join(builder.gopath, ".sandbox")
+			spec.Writable = append(spec.Writable, builder.gopath)
+
+			if builder.cache != "" {
+				spec.Writable = append(spec.Writable, builder.cache)
+			}
+
+			err := os.MkdirAll(spec.Root, 0755)
+			if err != nil {
+				return "", "", hierr.Errorf(
+					err, "can't create sandbox directory",
+				)
+			}
+		}
+
+		if sandboxed || !network {
+			if !sandboxed {
+				spec = sandboxSpec{}
+			}
+
+			spec.DisableNetwork = !network
+
+			err := sandboxCommand(cmd, spec)
+			if err != nil {
+				return "", "", hierr.Errorf(err, "can't sandbox command")
+			}
+		}
+	}
+
+	stdout, stderr, err := builder.quota.run(
+		cmd, builder.gopath, cancel, builder.processor.execute,
+	)
+	if err != nil && !network && isNetworkFailure(string(stdout)+string(stderr)) {
+		builder.logger.Errorf(
+			"%s failed, probably because network access is disabled "+
+				"for %s step", name, builder.step,
+		)
+	}
+
+	return builder.masker.Mask(string(stdout)),
+		builder.masker.Mask(string(stderr)),
+		err
+}
+
+// getStepEnvironment returns environment of build commands with secrets
+// which are passed to the current step.
+func (builder *stashBuilder) getStepEnvironment() []string {
+	environment := append([]string{}, builder.environment...)
+	for _, secret := range builder.secrets {
+		if !secret.isPassedTo(builder.step) {
+			continue
+		}
+
+		value := secret.Value
+		if secret.File {
+			value = builder.secretFiles[secret.Name]
+		}
+
+		environment = append(environment, secret.Name+"="+value)
+	}
+
+	return environment
+}
@@ -1,38 +1,32 @@
 package main
 
 import (
-	"errors"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"os/exec"
-	"path/filepath"
 	"strings"
 	"text/template"
 
 	"github.com/kovetskiy/stash"
-	"github.com/reconquest/executil-go"
 	"github.com/reconquest/hierr-go"
 	"github.com/seletskiy/tplutil"
 )
 
 type ProcessorStashPullRequest struct {
-	processor
+	stashBuilder
 
 	task        *TaskStashPullRequest
 	pullRequest stash.PullRequest
-	gopath      string
-	sources     string
-	makefile    struct {
-		build bool
-		test  bool
-	}
+
+	// approvalReason is a reason why the build needs approval.
+	approvalReason string
 }
 
 func NewProcessorStashPullRequest(
 	task *TaskStashPullRequest,
 ) *ProcessorStashPullRequest {
-	return &ProcessorStashPullRequest{task: task}
+	return &ProcessorStashPullRequest{
+		stashBuilder: stashBuilder{task: task},
+		task:         task,
+	}
 }
 
 func (processor *ProcessorStashPullRequest) Process() {
@@ -57,72 +51,71 @@ func (processor *ProcessorStashPullRequest) Process() {
 		return
 	}
 
-	err = processor.process()
-	if err != nil {
-		processor.logger.Error(err)
-		processor.task.SetState(TaskStateError)
-		processor.comment(TemplateCommentBuildFailure)
-		return
-	}
+	processor.branch = processor.pullRequest.FromRef.DisplayID
+	processor.target = processor.pullRequest.ToRef.DisplayID
 
-	processor.logger.Infof(":: build passing")
-	processor.task.SetState(TaskStateSuccess)
-	processor.comment(TemplateCommentBuildPassing)
-}
+	head := processor.pullRequest.FromRef.LatestCommit
+	if processor.task.GetCommit() == "" {
+		processor.task.SetCommit(head)
+	}
 
-func (processor *ProcessorStashPullRequest) process() error {
-	defer func() {
-		if processor.gopath != "" {
-			processor.logger.Debugf("removing directory %s", processor.gopath)
+	processor.approvalReason = processor.resources.getApprovalReason(
+		processor.task, processor.pullRequest,
+	)
+	if processor.approvalReason != "" {
+		approved := processor.task.IsApproved()
+		if approved && processor.task.GetCommit() != head {
+			processor.logger.Infof(
+				":: source branch is updated from %s to %s after approval",
+				processor.task.GetCommit(), head,
+			)
 
-			err := os.RemoveAll(processor.gopath)
-			if err != nil {
-				processor.logger.Errorf(
-					"can't remove directory %s: %s", processor.gopath, err,
-				)
-			}
+			approved = false
 		}
-	}()
 
-	err := processor.ensureBadge()
-	if err != nil {
-		return err
-	}
+		if !approved {
+			processor.task.SetCommit(head)
 
-	err = processor.fetch()
-	if err != nil {
-		return err
-	}
+			processor.logger.Infof(
+				":: build of %s is awaiting approval: %s",
+				head, processor.approvalReason,
+			)
+			processor.task.SetState(TaskStateAwaitingApproval)
 
-	processor.logger.Infof(":: successfully fetched")
+			if !processor.isApprovalRequested(head) {
+				processor.comment(TemplateCommentAwaitingApproval)
+			}
 
-	err = processor.lookupMakefileTargets()
-	if err != nil {
-		return err
-	}
+			return
+		}
 
-	err = processor.build()
-	if err != nil {
-		return err
-	}
+		processor.logger.Infof(
+			":: build is approved, running with restrictions of policy: %s",
+			processor.approvalReason,
+		)
 
-	processor.logger.Infof(":: successfully built")
+		processor.untrusted = true
+	}
 
-	err = processor.lint()
-	if err != nil {
-		return err
+	err = processor.ensureBadge()
+	if err == nil {
+		err = processor.process()
 	}
 
-	processor.logger.Infof(":: successfully linted")
+	if processor.resources.config.Resources.Lint.InlineComments {
+		processor.commentLintFindings()
+	}
 
-	err = processor.test()
 	if err != nil {
-		return err
+		processor.logger.Error(err)
+		processor.task.SetState(processor.getFailureState())
+		processor.comment(TemplateCommentBuildFailure)
+		return
 	}
 
-	processor.logger.Infof(":: successfully tested")
-
-	return nil
+	processor.logger.Infof(":: build passing")
+	processor.task.SetState(TaskStateSuccess)
+	processor.comment(TemplateCommentBuildPassing)
 }
 
 func (processor *ProcessorStashPullRequest) ensureBadge() error {
@@ -176,11 +169,24 @@ func (processor *ProcessorStashPullRequest) ensureBadge() error {
 func (processor *ProcessorStashPullRequest) comment(
 	template *template.Template,
 ) {
+	killed := ""
+	if usage := processor.task.GetResourceUsage(); usage != nil {
+		killed = usage.Killed
+	}
+
 	text, err := tplutil.ExecuteToString(template, map[string]interface{}{
-		"id":        processor.task.GetUniqueID(),
-		"logs":      processor.task.GetBuffer().String(),
-		"errors":    processor.task.GetErrorBuffer().String(),
-		"basic_url": processor.resources.config.Web.BasicURL,
+		"id":           processor.task.GetUniqueID(),
+		"state":        processor.task.GetState().String(),
+		"logs":         processor.task.GetBuffer().String(),
+		"errors":       processor.task.GetErrorBuffer().String(),
+		"lint":         strings.Join(processor.lintSummary, "\n"),
+		"failed_tests": processor.task.GetTestReport().GetFailedTests(),
+		"coverage":     processor.task.GetCoverage(),
+		"killed":       killed,
+		"reason":       processor.approvalReason,
+		"commit":       processor.task.GetCommit(),
+		"approve":      processor.resources.config.Policy.getApproveComment(),
+		"basic_url":    processor.resources.config.Web.BasicURL,
 	})
 	if err != nil {
 		processor.logger.Error(err)
@@ -208,317 +214,112 @@ func (processor *ProcessorStashPullRequest) comment(
 	processor.logger.Debugf("comment #%v created", comment.ID)
 }
 
-func (processor *ProcessorStashPullRequest) lint() error {
-	failures := []string{}
-	for linter, cmd := range processor.resources.linters {
-		processor.logger.Infof(
-			":: linting source code using %s",
-			linter,
-		)
-
-		_, err := processor.spawn("sh", "-c", cmd)
-		if err != nil {
-			if executil.IsExitError(err) {
-				output := strings.Split(
-					string(err.(*executil.Error).Output),
-					"\n",
-				)
-				for _, line := range output {
-					processor.logger.Error(line)
-				}
-
-				failures = append(failures, linter)
-				continue
-			}
-
-			return hierr.Errorf(
-				err,
-				"an error occurred while linting source code",
-			)
-		}
-	}
-
-	if len(failures) > 0 {
-		subject := "linter"
-		if len(failures) > 1 {
-			subject = "linters"
-		}
-
-		return fmt.Errorf(
-			"%s %s exited with non-zero exit code",
-			subject, strings.Join(failures, ", "),
-		)
-	}
-
-	return nil
-}
-
-func (processor *ProcessorStashPullRequest) build() error {
-	var stderr string
-	var err error
-	if processor.makefile.build {
-		processor.logger.Infof(":: building project using make build")
-
-		stderr, err = processor.makeBuild()
-	} else {
-		processor.logger.Infof(":: building project using go build")
-
-		stderr, err = processor.gobuild()
-	}
-
-	if err != nil {
-		if executil.IsExitError(err) {
-			output := strings.Split(stderr, "\n")
-			for _, line := range output {
-				processor.logger.Error(line)
-			}
-
-			if processor.makefile.build {
-				return errors.New("make build exited with non-zero exit code")
-			} else {
-				return errors.New("go build exited with non-zero exit code")
-			}
-		}
-
-		return hierr.Errorf(
-			err,
-			"can't build project",
-		)
-	}
-
-	return nil
-}
-
-func (processor *ProcessorStashPullRequest) test() error {
-	var stderr string
-	var err error
-	if processor.makefile.test {
-		processor.logger.Infof(":: testing project using make test")
-
-		stderr, err = processor.makeTest()
-	} else {
-		processor.logger.Infof(":: testing project using go test")
-
-		stderr, err = processor.gotest()
-	}
-
-	if err != nil {
-		if executil.IsExitError(err) {
-			output := strings.Split(stderr, "\n")
-			for _, line := range output {
-				processor.logger.Error(line)
-			}
-
-			if processor.makefile.test {
-				return errors.New("make test exited with non-zero exit code")
-			} else {
-				return errors.New("go test exited with non-zero exit code")
-			}
-		}
-
-		return hierr.Errorf(
-			err,
-			"can't test project",
-		)
-	}
-
-	return nil
-}
-
-func (processor *ProcessorStashPullRequest) lookupMakefileTargets() error {
-	contents, err := ioutil.ReadFile(
-		filepath.Join(processor.sources, "Makefile"),
-	)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-
-		return hierr.Errorf(
-			err,
-			"can't read Makefile",
-		)
-	}
-
-	for _, line := range strings.Split(string(contents), "\n") {
-		if strings.HasPrefix(line, "build:") {
-			processor.makefile.build = true
-		}
-
-		if strings.HasPrefix(line, "test:") {
-			processor.makefile.test = true
-		}
-
-		if processor.makefile.build && processor.makefile.test {
-			break
-		}
-	}
-
-	return nil
-}
-
-func (processor *ProcessorStashPullRequest) fetch() error {
-	var branch = processor.pullRequest.FromRef.DisplayID
-
-	processor.logger.Infof(
-		":: retrieving information about repository",
-	)
-
-	cloneURL, err := processor.getCloneURL()
-	if err != nil {
-		return hierr.Errorf(
-			err,
-			"can't obtain repository clone URL",
-		)
-	}
-
-	processor.logger.Infof(
-		":: cloning repository %s", cloneURL,
+// isApprovalRequested returns true if pull request already has comment which
+// requests approval of the given commit, so requeued tasks and new tasks of
+// the same commit don't duplicate it.
+func (processor *ProcessorStashPullRequest) isApprovalRequested(
+	commit string,
+) bool {
+	comments, err := processor.resources.stashAPI.GetComments(
+		processor.task.Project,
+		processor.task.Repository,
+		processor.task.Identifier,
 	)
-
-	err = processor.prepareSources(cloneURL, branch)
 	if err != nil {
-		return hierr.Errorf(
-			err,
-			"can't clone repository %s", cloneURL,
+		processor.logger.Error(
+			hierr.Errorf(
+				err,
+				"can't obtain existing comments of pull request",
+			),
 		)
+		return false
 	}
 
-	processor.logger.Infof(
-		":: fetching project's dependencies",
-	)
-
-	stderr, err := processor.goget()
-	if err != nil {
-		if executil.IsExitError(err) {
-			output := strings.Split(stderr, "\n")
-			for _, line := range output {
-				processor.logger.Error(line)
-			}
-
-			return errors.New("go get exited with non-zero exit code")
+	for _, comment := range comments {
+		if commit != "" && comment.Anchor == nil &&
+			strings.Contains(comment.Text, pathBadgeState+"awaiting-approval") &&
+			strings.Contains(comment.Text, commit) {
+			return true
 		}
-
-		return hierr.Errorf(
-			err,
-			"can't fetch project's dependencies",
-		)
 	}
 
-	return nil
+	return false
 }
 
-func (processor *ProcessorStashPullRequest) getCloneURL() (string, error) {
-	url := cache.Get(
-		processor.task.Host,
-		processor.task.Project,
-		processor.task.Repository,
-	)
-	if url != "" {
-		return url, nil
+// commentLintFindings creates comments on lines of pull request files which
+// have lint findings, only lines added by the pull request can be commented,
+// lines which already have the same comment are skipped, so rebuilds don't
+// duplicate comments.
+func (processor *ProcessorStashPullRequest) commentLintFindings() {
+	comments := getLintLineComments(processor.task.GetLintFindings())
+	if len(comments) == 0 {
+		return
 	}
 
-	repository, err := processor.resources.stash.GetRepository(
-		processor.task.Project,
-		processor.task.Repository,
-	)
-	if err != nil {
-		return "", hierr.Errorf(
-			err,
-			"can't obtain information about specified repository",
+	if processor.diff == nil {
+		processor.logger.Warning(
+			"diff of pull request is not obtained, inline comments are skipped",
 		)
+		return
 	}
 
-	cache.Set(
-		repository.SshUrl(),
-		processor.task.Host,
+	existing, err := processor.resources.stashAPI.GetLineComments(
 		processor.task.Project,
 		processor.task.Repository,
+		processor.task.Identifier,
 	)
-
-	return repository.SshUrl(), nil
-}
-
-func (processor *ProcessorStashPullRequest) prepareSources(
-	url, branch string,
-) error {
-	gopath, err := ioutil.TempDir(os.TempDir(), "uroboros_")
 	if err != nil {
-		return hierr.Errorf(
-			err, "can't create temporary directory",
+		processor.logger.Error(
+			hierr.Errorf(
+				err,
+				"can't obtain existing comments of pull request",
+			),
 		)
+		return
 	}
 
-	sources := filepath.Join(
-		gopath, "src",
-		processor.task.Host, processor.task.Project, processor.task.Repository,
-	)
-
-	_, err = processor.spawn("git", "clone", url, sources)
-	if err != nil {
-		return err
-	}
-
-	processor.gopath = gopath
-	processor.sources = sources
-
-	processor.logger.Infof(
-		":: switching to branch %s", branch,
-	)
-
-	_, err = processor.spawn("git", "checkout", branch)
-	if err != nil {
-		return err
-	}
-
-	_, err = processor.spawn(
-		"git", "submodule", "update", "--recursive", "--init",
-	)
-	if err != nil {
-		return err
+	posted := map[string]bool{}
+	for _, comment := range existing {
+		posted[fmt.Sprintf(
+			"%s:%d:%s", comment.Anchor.Path, comment.Anchor.Line, comment.Text,
+		)] = true
 	}
 
-	return nil
-}
-
-func (processor *ProcessorStashPullRequest) goget() (string, error) {
-	return processor.spawn("go", "get", "-v", "-t", "-d")
-}
-
-func (processor *ProcessorStashPullRequest) gobuild() (string, error) {
-	return processor.spawn("go", "build", "-gcflags", "-e")
-}
-
-func (processor *ProcessorStashPullRequest) gotest() (string, error) {
-	return processor.spawn("go", "test", "-gcflags", "-e")
-}
-
-func (processor *ProcessorStashPullRequest) makeBuild() (string, error) {
-	return processor.spawn("make", "build")
-}
-
-func (processor *ProcessorStashPullRequest) makeTest() (string, error) {
-	return processor.spawn("make", "test")
-}
+	for _, comment := range comments {
+		if posted[fmt.Sprintf(
+			"%s:%d:%s", comment.File, comment.Line, comment.Text,
+		)] {
+			continue
+		}
 
-func (processor *ProcessorStashPullRequest) spawn(
-	name string, arg ...string,
-) (string, error) {
-	cmd := exec.Command(name, arg...)
+		processor.logger.Debugf(
+			"creating comment on %s:%d", comment.File, comment.Line,
+		)
 
-	if processor.sources != "" {
-		cmd.Dir = processor.sources
-	}
+		// Stash rejects comments anchored to lines outside of the diff.
+		if !processor.diff.IsAdded(comment.File, comment.Line) {
+			continue
+		}
 
-	if processor.gopath != "" {
-		cmd.Env = append(
-			[]string{
-				"GOPATH=" + processor.gopath,
+		_, err := processor.resources.stashAPI.CreateComment(
+			processor.task.Project,
+			processor.task.Repository,
+			processor.task.Identifier,
+			StashComment{
+				Text: comment.Text,
+				Anchor: &StashCommentAnchor{
+					Path:     comment.File,
+					Line:     comment.Line,
+					LineType: "ADDED",
+					FileType: "TO",
+				},
 			},
-			os.Environ()...,
 		)
+		if err != nil {
+			processor.logger.Warningf(
+				"can't create comment on %s:%d: %s",
+				comment.File, comment.Line, err,
+			)
+		}
 	}
-
-	_, stderr, err := processor.processor.execute(cmd)
-	return string(stderr), err
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"regexp"
+)
+
+// Build steps which can be configured in steps section.
+const (
+	stepFetch    = "fetch"
+	stepBuild    = "build"
+	stepLint     = "lint"
+	stepTest     = "test"
+	stepCoverage = "coverage"
+)
+
+var reNetworkFailure = regexp.MustCompile(
+	`(?i)network is unreachable|no such host|` +
+		`temporary failure in name resolution|could not resolve host|` +
+		`dial (tcp|udp)[^:]*:|connection refused`,
+)
+
+// Step is a configuration of the build step:
+//
+//	[steps.test]
+//	  network = false
+type Step struct {
+	Network *bool
+}
+
+func isKnownStep(name string) bool {
+	switch name {
+	case stepFetch, stepBuild, stepLint, stepTest, stepCoverage:
+		return true
+	default:
+		return false
+	}
+}
+
+// isNetworkEnabled returns false if the step is configured to run without
+// network access.
+func (resources *resources) isNetworkEnabled(step string) bool {
+	config, ok := resources.config.Steps[step]
+	if !ok || config.Network == nil {
+		return true
+	}
+
+	return *config.Network
+}
+
+// isNetworkFailure returns true if output of the command looks like the
+// command tried to access network.
+func isNetworkFailure(output string) bool {
+	return reNetworkFailure.MatchString(output)
+}
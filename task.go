@@ -1,21 +1,29 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
 )
 
 type TaskState int
 
-var (
-	TaskStateUnknown    TaskState = 0
-	TaskStateQueued     TaskState = 10
-	TaskStateProcessing TaskState = 20
-	TaskStateError      TaskState = 30
-	TaskStateSuccess    TaskState = 40
+const (
+	TaskStateUnknown          TaskState = 0
+	TaskStateAwaitingApproval TaskState = 5
+	TaskStateQueued           TaskState = 10
+	TaskStateProcessing       TaskState = 20
+	TaskStateError            TaskState = 30
+	TaskStateSuccess          TaskState = 40
+	TaskStateCancelled        TaskState = 50
+	TaskStateTimedOut         TaskState = 60
 )
 
 func (state TaskState) String() string {
 	switch state {
+	case TaskStateAwaitingApproval:
+		return "awaiting-approval"
 	case TaskStateQueued:
 		return "queued"
 	case TaskStateProcessing:
@@ -24,28 +32,158 @@ func (state TaskState) String() string {
 		return "error"
 	case TaskStateSuccess:
 		return "success"
+	case TaskStateCancelled:
+		return "cancelled"
+	case TaskStateTimedOut:
+		return "timed-out"
 	default:
 		return "unknown"
 	}
 }
 
+func ParseTaskState(value string) (TaskState, error) {
+	for _, state := range []TaskState{
+		TaskStateAwaitingApproval,
+		TaskStateQueued,
+		TaskStateProcessing,
+		TaskStateError,
+		TaskStateSuccess,
+		TaskStateCancelled,
+		TaskStateTimedOut,
+	} {
+		if value == state.String() {
+			return state, nil
+		}
+	}
+
+	return TaskStateUnknown, fmt.Errorf("unknown task state '%s'", value)
+}
+
+// IsFinished returns true if the task in this state will never be processed
+// again.
+func (state TaskState) IsFinished() bool {
+	switch state {
+	case TaskStateError, TaskStateSuccess, TaskStateCancelled, TaskStateTimedOut:
+		return true
+	default:
+		return false
+	}
+}
+
+type TaskPriority int
+
+const (
+	TaskPriorityLow    TaskPriority = 10
+	TaskPriorityNormal TaskPriority = 20
+	TaskPriorityHigh   TaskPriority = 30
+)
+
+func (priority TaskPriority) String() string {
+	switch priority {
+	case TaskPriorityLow:
+		return "low"
+	case TaskPriorityNormal:
+		return "normal"
+	case TaskPriorityHigh:
+		return "high"
+	default:
+		return "unknown"
+	}
+}
+
+func ParseTaskPriority(value string) (TaskPriority, error) {
+	switch value {
+	case "low":
+		return TaskPriorityLow, nil
+	case "", "normal":
+		return TaskPriorityNormal, nil
+	case "high":
+		return TaskPriorityHigh, nil
+	default:
+		return TaskPriorityNormal, fmt.Errorf(
+			"unknown priority '%s', expected low, normal or high", value,
+		)
+	}
+}
+
 type Task interface {
 	GetUniqueID() int64
 	SetUniqueID(int64)
 	GetState() TaskState
 	SetState(TaskState)
-	GetBuffer() *bytes.Buffer
-	GetErrorBuffer() *bytes.Buffer
+	GetPriority() TaskPriority
+	SetPriority(TaskPriority)
+	GetLabels() []string
+	SetLabels([]string)
+	GetStartedAt() time.Time
+	SetStartedAt(time.Time)
+	GetFinishedAt() time.Time
+	SetFinishedAt(time.Time)
+	GetBuffer() *Buffer
+	GetErrorBuffer() *Buffer
+	GetLintFindings() []LintFinding
+	SetLintFindings([]LintFinding)
+	GetTestReport() *TestReport
+	SetTestReport(*TestReport)
+	GetCoverage() *CoverageReport
+	SetCoverage(*CoverageReport)
+	GetResourceUsage() *ResourceUsage
+	SetResourceUsage(*ResourceUsage)
+	GetEnvironment() []string
+	SetEnvironment([]string)
+	IsApproved() bool
+	SetApproved(bool)
+	GetCommit() string
+	SetCommit(string)
+	GetContext() context.Context
+	Cancel()
 	GetTitle() string
 	GetIdentifier() string
+	GetHost() string
+	GetProject() string
+	GetRepository() string
+}
+
+// NewTaskFromURL creates build task of Stash pull request or branch by its
+// URL.
+func NewTaskFromURL(url string) (Task, error) {
+	if reStashBranchURL.MatchString(url) {
+		task, err := NewTaskStashBranch(url)
+		if err != nil {
+			return nil, err
+		}
+
+		return task, nil
+	}
+
+	task, err := NewTaskStashPullRequest(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return task, nil
 }
 
 type task struct {
 	unique      int64
 	identifier  string
 	state       TaskState
-	buffer      *bytes.Buffer
-	errorBuffer *bytes.Buffer
+	priority    TaskPriority
+	labels      []string
+	startedAt   time.Time
+	finishedAt  time.Time
+	buffer      Buffer
+	errorBuffer Buffer
+	findings    []LintFinding
+	tests       *TestReport
+	coverage    *CoverageReport
+	usage       *ResourceUsage
+	environment []string
+	approved    bool
+	commit      string
+	ctx         context.Context
+	cancel      context.CancelFunc
+	mutex       sync.Mutex
 }
 
 func (task *task) GetUniqueID() int64 {
@@ -68,18 +206,128 @@ func (task *task) SetState(state TaskState) {
 	task.state = state
 }
 
-func (task *task) GetBuffer() *bytes.Buffer {
-	if task.buffer == nil {
-		task.buffer = &bytes.Buffer{}
+func (task *task) GetPriority() TaskPriority {
+	if task.priority == 0 {
+		return TaskPriorityNormal
 	}
 
-	return task.buffer
+	return task.priority
+}
+
+func (task *task) SetPriority(priority TaskPriority) {
+	task.priority = priority
+}
+
+func (task *task) GetLabels() []string {
+	return task.labels
+}
+
+func (task *task) SetLabels(labels []string) {
+	task.labels = labels
+}
+
+func (task *task) GetStartedAt() time.Time {
+	return task.startedAt
+}
+
+func (task *task) SetStartedAt(at time.Time) {
+	task.startedAt = at
+}
+
+func (task *task) GetFinishedAt() time.Time {
+	return task.finishedAt
 }
 
-func (task *task) GetErrorBuffer() *bytes.Buffer {
-	if task.errorBuffer == nil {
-		task.errorBuffer = &bytes.Buffer{}
+func (task *task) SetFinishedAt(at time.Time) {
+	task.finishedAt = at
+}
+
+func (task *task) GetBuffer() *Buffer {
+	return &task.buffer
+}
+
+func (task *task) GetErrorBuffer() *Buffer {
+	return &task.errorBuffer
+}
+
+func (task *task) GetLintFindings() []LintFinding {
+	return task.findings
+}
+
+func (task *task) SetLintFindings(findings []LintFinding) {
+	task.findings = findings
+}
+
+func (task *task) GetTestReport() *TestReport {
+	return task.tests
+}
+
+func (task *task) SetTestReport(report *TestReport) {
+	task.tests = report
+}
+
+func (task *task) GetCoverage() *CoverageReport {
+	return task.coverage
+}
+
+func (task *task) SetCoverage(report *CoverageReport) {
+	task.coverage = report
+}
+
+func (task *task) GetResourceUsage() *ResourceUsage {
+	return task.usage
+}
+
+func (task *task) SetResourceUsage(usage *ResourceUsage) {
+	task.usage = usage
+}
+
+func (task *task) GetEnvironment() []string {
+	return task.environment
+}
+
+func (task *task) SetEnvironment(environment []string) {
+	task.environment = environment
+}
+
+func (task *task) IsApproved() bool {
+	return task.approved
+}
+
+func (task *task) SetApproved(approved bool) {
+	task.approved = approved
+}
+
+// GetCommit returns commit which is built, it's recorded when the task is
+// processed first time, approval of the task is bound to this commit.
+func (task *task) GetCommit() string {
+	return task.commit
+}
+
+func (task *task) SetCommit(commit string) {
+	task.commit = commit
+}
+
+// GetContext returns context of the task, which is done when the task is
+// cancelled.
+func (task *task) GetContext() context.Context {
+	task.mutex.Lock()
+	defer task.mutex.Unlock()
+
+	if task.ctx == nil {
+		task.ctx, task.cancel = context.WithCancel(context.Background())
 	}
 
-	return task.errorBuffer
+	return task.ctx
+}
+
+// Cancel cancels context of the task, so processing of the task is
+// interrupted.
+func (task *task) Cancel() {
+	task.GetContext()
+
+	task.mutex.Lock()
+	defer task.mutex.Unlock()
+
+	task.cancel()
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var reStashBranchURL = regexp.MustCompile(
+	`(https?://(.*)/)` +
+		`((users|projects)/([^/]+))` +
+		`/repos/([^/]+)` +
+		`/browse\?at=(.+)$`,
+)
+
+// TaskStashBranch is a build of the repository branch, its URL is the Stash
+// URL of the branch, like
+// http://git.local/projects/PRJ/repos/repo/browse?at=refs/heads/master
+type TaskStashBranch struct {
+	task
+	URL        string
+	BasicURL   string
+	Host       string
+	Project    string
+	Repository string
+	Branch     string
+}
+
+func NewTaskStashBranch(branchURL string) (*TaskStashBranch, error) {
+	matches := reStashBranchURL.FindStringSubmatch(branchURL)
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("URL doesn't seem like Stash branch")
+	}
+
+	branch, err := url.QueryUnescape(matches[7])
+	if err != nil {
+		return nil, fmt.Errorf("can't unescape branch name: %s", err)
+	}
+
+	task := &TaskStashBranch{
+		URL:        branchURL,
+		BasicURL:   matches[1],
+		Host:       matches[2],
+		Project:    strings.ToLower(matches[5]),
+		Repository: matches[6],
+		Branch:     strings.TrimPrefix(branch, "refs/heads/"),
+	}
+
+	task.identifier = getBranchIdentifier(
+		task.Host, task.Project, task.Repository, task.Branch,
+	)
+
+	return task, nil
+}
+
+// getBranchIdentifier returns identifier of branch builds, it's distinct
+// from pull request identifiers because of the branch/ part.
+func getBranchIdentifier(host, project, repository, branch string) string {
+	return fmt.Sprintf(
+		"%s/%s/%s/branch/%s",
+		host, strings.ToLower(project), repository, branch,
+	)
+}
+
+func (branch *TaskStashBranch) GetTitle() string {
+	return fmt.Sprintf(
+		"[stash branch] %s/%s/%s %s",
+		branch.Host, branch.Project, branch.Repository, branch.Branch,
+	)
+}
+
+func (branch *TaskStashBranch) GetHost() string {
+	return branch.Host
+}
+
+func (branch *TaskStashBranch) GetProject() string {
+	return branch.Project
+}
+
+func (branch *TaskStashBranch) GetRepository() string {
+	return branch.Repository
+}
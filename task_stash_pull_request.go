@@ -56,3 +56,15 @@ func (request *TaskStashPullRequest) GetTitle() string {
 		request.Identifier,
 	)
 }
+
+func (request *TaskStashPullRequest) GetHost() string {
+	return request.Host
+}
+
+func (request *TaskStashPullRequest) GetProject() string {
+	return request.Project
+}
+
+func (request *TaskStashPullRequest) GetRepository() string {
+	return request.Repository
+}
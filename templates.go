@@ -15,15 +15,30 @@ var (
 var (
 	TemplateCommentBuildPassing = template.Must(template.New("").Parse(
 		"# [![uroboros: build passing](" +
-			"{{ .basic_url }}" + pathStaticBadgeBuildPassing +
+			"{{ .basic_url }}" + pathBadgeState + "success" +
 			")]({{ .basic_url }}/status/{{ .id }})" +
+			"{{ if .coverage }}\n**Coverage:** {{ .coverage }}\n{{ end }}" +
+			"{{ if .lint }}\n```\n{{ .lint }}\n```{{ end }}" +
 			"\n```\n{{ .logs }}\n```",
 	))
 
+	TemplateCommentAwaitingApproval = template.Must(template.New("").Parse(
+		"# [![uroboros: awaiting approval](" +
+			"{{ .basic_url }}" + pathBadgeState + "awaiting-approval" +
+			")]({{ .basic_url }}/status/{{ .id }})" +
+			"\nBuild of commit {{ .commit }} is awaiting approval: {{ .reason }}." +
+			"\nMaintainer can approve it by commenting `{{ .approve }}`.",
+	))
+
 	TemplateCommentBuildFailure = template.Must(template.New("").Parse(
-		"# [![uroboros: build failure](" +
-			"{{ .basic_url }}" + pathStaticBadgeBuildFailure +
+		"# [![uroboros: build {{ .state }}](" +
+			"{{ .basic_url }}" + pathBadgeState + "{{ .state }}" +
 			")]({{ .basic_url }}/status/{{ .id }})" +
+			"{{ if .failed_tests }}\n**Failed tests:**\n" +
+			"{{ range .failed_tests }}* `{{ . }}`\n{{ end }}{{ end }}" +
+			"{{ if .killed }}\n**Killed:** {{ .killed }}\n{{ end }}" +
+			"{{ if .coverage }}\n**Coverage:** {{ .coverage }}\n{{ end }}" +
+			"{{ if .lint }}\n```\n{{ .lint }}\n```{{ end }}" +
 			"\n```\n{{ .errors }}\n```",
 	))
 )
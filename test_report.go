@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+const (
+	testResultPass = "pass"
+	testResultFail = "fail"
+	testResultSkip = "skip"
+)
+
+type TestCase struct {
+	Name    string  `json:"name"`
+	Result  string  `json:"result"`
+	Elapsed float64 `json:"elapsed"`
+	Output  string  `json:"output,omitempty"`
+}
+
+type TestPackage struct {
+	Name    string     `json:"name"`
+	Result  string     `json:"result"`
+	Elapsed float64    `json:"elapsed"`
+	Output  string     `json:"output,omitempty"`
+	Tests   []TestCase `json:"tests"`
+}
+
+type TestReport struct {
+	Packages []TestPackage `json:"packages"`
+}
+
+// testEvent is an event emitted by go test -json, see go doc test2json.
+type testEvent struct {
+	Action  string
+	Package string
+	Test    string
+	Elapsed float64
+	Output  string
+}
+
+// parseTestEvents builds report from output of go test -json, lines which
+// are not JSON events are ignored.
+func parseTestEvents(output string) *TestReport {
+	var (
+		packages = []*TestPackage{}
+		indexes  = map[string]*TestPackage{}
+		tests    = map[string]map[string]int{}
+	)
+
+	for _, line := range strings.Split(output, "\n") {
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+
+		var event testEvent
+		err := json.Unmarshal([]byte(line), &event)
+		if err != nil || event.Package == "" {
+			continue
+		}
+
+		pkg, ok := indexes[event.Package]
+		if !ok {
+			pkg = &TestPackage{Name: event.Package, Tests: []TestCase{}}
+			packages = append(packages, pkg)
+			indexes[event.Package] = pkg
+			tests[event.Package] = map[string]int{}
+		}
+
+		if event.Test == "" {
+			switch event.Action {
+			case "output":
+				pkg.Output += event.Output
+
+			case testResultPass, testResultFail, testResultSkip:
+				pkg.Result = event.Action
+				pkg.Elapsed = event.Elapsed
+			}
+
+			continue
+		}
+
+		index, ok := tests[event.Package][event.Test]
+		if !ok {
+			index = len(pkg.Tests)
+			pkg.Tests = append(pkg.Tests, TestCase{Name: event.Test})
+			tests[event.Package][event.Test] = index
+		}
+
+		test := &pkg.Tests[index]
+
+		switch event.Action {
+		case "output":
+			test.Output += event.Output
+
+		case testResultPass, testResultFail, testResultSkip:
+			test.Result = event.Action
+			test.Elapsed = event.Elapsed
+		}
+	}
+
+	report := &TestReport{Packages: []TestPackage{}}
+	for _, pkg := range packages {
+		report.Packages = append(report.Packages, *pkg)
+	}
+
+	return report
+}
+
+// GetFailedTests returns names of failed tests prefixed with package names,
+// packages which failed without failed tests (e.g. build failures or panics
+// in init) are returned as package names.
+func (report *TestReport) GetFailedTests() []string {
+	failed := []string{}
+	if report == nil {
+		return failed
+	}
+
+	for _, pkg := range report.Packages {
+		found := false
+		for _, test := range pkg.Tests {
+			if test.Result == testResultFail {
+				failed = append(failed, pkg.Name+"."+test.Name)
+				found = true
+			}
+		}
+
+		if !found && pkg.Result == testResultFail {
+			failed = append(failed, pkg.Name)
+		}
+	}
+
+	return failed
+}
+
+// GetCounts returns amount of passed, failed and skipped tests.
+func (report *TestReport) GetCounts() (int, int, int) {
+	var passed, failed, skipped int
+	if report == nil {
+		return passed, failed, skipped
+	}
+
+	for _, pkg := range report.Packages {
+		for _, test := range pkg.Tests {
+			switch test.Result {
+			case testResultPass:
+				passed++
+			case testResultFail:
+				failed++
+			case testResultSkip:
+				skipped++
+			}
+		}
+	}
+
+	return passed, failed, skipped
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"crypto/sha1"
 	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/kovetskiy/lorg"
 )
@@ -25,6 +27,24 @@ func (server *WebServer) HandleWeb(
 
 	requestURL := request.URL.Path
 
+	// static badges were available without authorization.
+	if strings.HasPrefix(requestURL, pathStaticBadges) {
+		logger.Infof("handled request: get static badge")
+		server.handleStaticBadge(
+			writer,
+			request,
+			logger,
+			strings.TrimPrefix(requestURL, pathStaticBadges),
+		)
+		return
+	}
+
+	if status := server.authorizeWeb(request); status != http.StatusOK {
+		writeUnauthorized(writer, status)
+		writeStatus(writer, logger, status)
+		return
+	}
+
 	switch {
 	case strings.HasPrefix(requestURL, pathStatus):
 		logger.Infof("handled request: get task status")
@@ -33,9 +53,39 @@ func (server *WebServer) HandleWeb(
 			strings.Trim(strings.TrimPrefix(requestURL, pathStatus), "/"),
 		)
 
+	case strings.HasPrefix(requestURL, pathBadgeCoverage):
+		logger.Infof("handled request: get coverage badge")
+		server.handleCoverageBadge(
+			writer,
+			request,
+			logger,
+			strings.Trim(strings.TrimPrefix(requestURL, pathBadgeCoverage), "/"),
+		)
+
+	case strings.HasPrefix(requestURL, pathBadgeState):
+		logger.Infof("handled request: get state badge")
+		server.handleStateBadge(
+			writer,
+			request,
+			logger,
+			strings.Trim(strings.TrimPrefix(requestURL, pathBadgeState), "/"),
+		)
+
+	case isLegacyStateBadge(requestURL):
+		logger.Infof("handled request: get legacy state badge")
+		http.Redirect(
+			writer, request,
+			pathBadgeState+strings.Trim(
+				strings.TrimPrefix(requestURL, pathLegacyBadgeState), "/",
+			),
+			http.StatusMovedPermanently,
+		)
+
 	case strings.HasPrefix(requestURL, pathBadge):
+		logger.Infof("handled request: get badge")
 		server.handleBadge(
 			writer,
+			request,
 			logger,
 			strings.Trim(strings.TrimPrefix(requestURL, pathBadge), "/"),
 		)
@@ -54,10 +104,15 @@ func (server *WebServer) getTask(logger *lorg.Log, query string) (Task, error) {
 		}
 
 		logger.Debugf("get task by unique id = %d", taskID)
-		task = server.resources.queue.GetTaskByUniqueID(taskID)
+		task = server.getResources().queue.GetTaskByUniqueID(taskID)
+	} else if strings.Contains(query, "/branch/") {
+		logger.Debugf("get latest finished task of branch = %s", query)
+		task = server.getResources().queue.GetLatestFinishedTaskByIdentifier(
+			query,
+		)
 	} else {
 		logger.Debugf("get task by identifier = %s", query)
-		task = server.resources.queue.GetTaskByIdentifier(query)
+		task = server.getResources().queue.GetTaskByIdentifier(query)
 	}
 
 	return task, nil
@@ -81,11 +136,68 @@ func (server *WebServer) handleStatus(
 	}
 
 	writeStatus(writer, logger, http.StatusOK)
-	fmt.Fprintf(writer, "%s\n----\n%s", task.GetState(), task.GetBuffer())
+
+	fmt.Fprintf(writer, "%s\n", task.GetState())
+
+	estimate := server.getEstimates()[task.GetUniqueID()]
+	if estimate.Position > 0 {
+		fmt.Fprintf(
+			writer, "position: %d (%d tasks ahead)\n",
+			estimate.Position, estimate.Ahead,
+		)
+	}
+
+	if !estimate.StartAt.IsZero() {
+		fmt.Fprintf(
+			writer, "estimated start: %s\n",
+			estimate.StartAt.Format(time.RFC1123),
+		)
+	}
+
+	if !estimate.FinishAt.IsZero() {
+		fmt.Fprintf(
+			writer, "estimated finish: %s\n",
+			estimate.FinishAt.Format(time.RFC1123),
+		)
+	}
+
+	if report := task.GetTestReport(); report != nil {
+		passed, failed, skipped := report.GetCounts()
+		fmt.Fprintf(
+			writer, "tests: %d passed, %d failed, %d skipped\n",
+			passed, failed, skipped,
+		)
+
+		for _, test := range report.GetFailedTests() {
+			fmt.Fprintf(writer, "failed: %s\n", test)
+		}
+	}
+
+	if report := task.GetCoverage(); report != nil {
+		fmt.Fprintf(writer, "coverage: %s\n", report)
+	}
+
+	if usage := task.GetResourceUsage(); usage != nil {
+		fmt.Fprintf(writer, "resources: %s\n", usage)
+	}
+
+	fmt.Fprintf(writer, "----\n%s", task.GetBuffer())
+}
+
+// getEstimates estimates pending tasks using all build slots: threads of
+// the local scheduler and threads of registered agents.
+func (server *WebServer) getEstimates() map[int64]Estimate {
+	resources := server.getResources()
+
+	return resources.queue.Estimate(
+		server.scheduler.GetThreads()+resources.agents.GetThreads(),
+		resources.history,
+	)
 }
 
 func (server *WebServer) handleBadge(
 	writer http.ResponseWriter,
+	request *http.Request,
 	logger *lorg.Log,
 	query string,
 ) {
@@ -101,21 +213,132 @@ func (server *WebServer) handleBadge(
 		return
 	}
 
-	var path string
-	switch task.GetState() {
-	case TaskStateSuccess:
-		path = pathStaticBadgeBuildPassing
+	label, message, color, err := getTaskBadge(
+		task, request.URL.Query().Get("value"),
+	)
+	if err != nil {
+		writeStatus(writer, logger, http.StatusBadRequest)
+		logger.Error(err)
+		return
+	}
 
-	case TaskStateError:
-		path = pathStaticBadgeBuildFailure
+	writeBadge(writer, request, logger, label, message, color)
+}
 
-	default:
-		path = pathStaticBadgeBuildProcessing
+// handleStateBadge renders badge of given task state, such badges never
+// change, so they are used in pull request comments.
+func (server *WebServer) handleStateBadge(
+	writer http.ResponseWriter,
+	request *http.Request,
+	logger *lorg.Log,
+	query string,
+) {
+	state, err := ParseTaskState(query)
+	if err != nil {
+		writeStatus(writer, logger, http.StatusNotFound)
+		logger.Error(err)
+		return
+	}
+
+	message, color := getStateBadge(state)
+
+	writeBadge(writer, request, logger, "build", message, color)
+}
+
+// isLegacyStateBadge returns true if the path is a path of state badge with
+// legacy prefix, path of badge of task of repository on host named state
+// can't be confused with it because it has more parts.
+func isLegacyStateBadge(path string) bool {
+	if !strings.HasPrefix(path, pathLegacyBadgeState) {
+		return false
+	}
+
+	_, err := ParseTaskState(
+		strings.Trim(strings.TrimPrefix(path, pathLegacyBadgeState), "/"),
+	)
+
+	return err == nil
+}
+
+// handleStaticBadge redirects request of static badge to the badge of the
+// same state, so links in already posted comments keep working.
+func (server *WebServer) handleStaticBadge(
+	writer http.ResponseWriter,
+	request *http.Request,
+	logger *lorg.Log,
+	name string,
+) {
+	state, ok := staticBadges[name]
+	if !ok {
+		writeStatus(writer, logger, http.StatusNotFound)
+		return
+	}
+
+	http.Redirect(
+		writer, request, pathBadgeState+state.String(),
+		http.StatusMovedPermanently,
+	)
+}
+
+// handleCoverageBadge renders badge with coverage of the latest successful
+// build of the repository branch.
+func (server *WebServer) handleCoverageBadge(
+	writer http.ResponseWriter,
+	request *http.Request,
+	logger *lorg.Log,
+	query string,
+) {
+	slug, branch, err := parseCoverageQuery(query)
+	if err != nil {
+		writeStatus(writer, logger, http.StatusBadRequest)
+		logger.Error(err)
+		return
+	}
+
+	message, color := getCoverageBadge(
+		server.getResources().coverage.GetLatest(slug, branch),
+	)
+
+	writeBadge(writer, request, logger, "coverage", message, color)
+}
+
+// writeBadge renders badge and writes it with ETag, so clients revalidate
+// badge on every request, but download it only when it's changed. Label can
+// be overridden by label query parameter.
+func writeBadge(
+	writer http.ResponseWriter,
+	request *http.Request,
+	logger *lorg.Log,
+	label, message, color string,
+) {
+	if value := request.URL.Query().Get("label"); value != "" {
+		label = value
+	}
+
+	badge, err := renderBadge(label, message, color)
+	if err != nil {
+		writeStatus(writer, logger, http.StatusInternalServerError)
+		logger.Error(err)
+		return
+	}
+
+	etag := fmt.Sprintf(`"%x"`, sha1.Sum(badge))
+
+	writer.Header().Set("Content-Type", "image/svg+xml")
+	writer.Header().Set("Cache-Control", "no-cache, max-age=0")
+	writer.Header().Set("ETag", etag)
+
+	if request.Header.Get("If-None-Match") == etag {
+		writeStatus(writer, logger, http.StatusNotModified)
+		return
 	}
 
-	logger.Infof("<- %s", path)
-	writer.Header().Set("Location", path)
-	writeStatus(writer, logger, http.StatusTemporaryRedirect)
+	writeStatus(writer, logger, http.StatusOK)
+
+	_, err = writer.Write(badge)
+	if err != nil {
+		logger.Error(err)
+	}
 }
 
 func writeStatus(writer http.ResponseWriter, logger lorg.Logger, status int) {
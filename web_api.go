@@ -2,12 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
-	"strconv"
 	"strings"
 	"sync/atomic"
 
 	"github.com/kovetskiy/lorg"
+	"github.com/reconquest/hierr-go"
 )
 
 func (server *WebServer) HandleAPI(
@@ -32,6 +34,20 @@ func (server *WebServer) HandleAPI(
 		status, http.StatusText(status),
 	)
 
+	writeUnauthorized(writer, status)
+
+	if raw, ok := response.(ResponseRaw); ok {
+		writer.Header().Set("Content-Type", raw.ContentType)
+		writer.WriteHeader(status)
+
+		_, err := writer.Write(raw.Body)
+		if err != nil {
+			logger.Error(err)
+		}
+
+		return
+	}
+
 	writer.WriteHeader(status)
 
 	if response != nil {
@@ -56,10 +72,20 @@ func (server *WebServer) routeAPI(
 	case requestURL == "/tasks/":
 		switch request.Method {
 		case "POST":
+			status = server.authorize(request, scopeSubmit)
+			if status != http.StatusOK {
+				return status, nil
+			}
+
 			logger.Infof("handled request: new task")
 			return server.handleNewTask(logger, request)
 
 		case "GET":
+			status = server.authorize(request, scopeRead)
+			if status != http.StatusOK {
+				return status, nil
+			}
+
 			logger.Infof("handled request: list tasks")
 			return server.handleListTasks(logger)
 
@@ -68,10 +94,92 @@ func (server *WebServer) routeAPI(
 		}
 
 	case strings.HasPrefix(requestURL, "/tasks/"):
-		logger.Infof("handled request: get task")
-		return server.handleTask(
+		query := strings.Trim(strings.TrimPrefix(requestURL, "/tasks/"), "/")
+
+		switch request.Method {
+		case "GET":
+			status = server.authorize(request, scopeRead)
+			if status != http.StatusOK {
+				return status, nil
+			}
+
+			for format := range taskExportFormats {
+				if strings.HasSuffix(query, "/"+format) {
+					logger.Infof("handled request: export task as %s", format)
+					return server.handleExportTask(
+						logger, strings.TrimSuffix(query, "/"+format), format,
+					)
+				}
+			}
+
+			logger.Infof("handled request: get task")
+			return server.handleTask(logger, query)
+
+		case "POST":
+			status = server.authorize(request, scopeSubmit)
+			if status != http.StatusOK {
+				return status, nil
+			}
+
+			logger.Infof("handled request: update task")
+			return server.handleUpdateTask(logger, request, query)
+
+		default:
+			return http.StatusMethodNotAllowed, nil
+		}
+
+	case strings.HasPrefix(requestURL, "/coverage/"):
+		if request.Method != "GET" {
+			return http.StatusMethodNotAllowed, nil
+		}
+
+		status = server.authorize(request, scopeRead)
+		if status != http.StatusOK {
+			return status, nil
+		}
+
+		logger.Infof("handled request: coverage history")
+		return server.handleCoverage(
 			logger,
-			strings.Trim(strings.TrimPrefix(requestURL, "/tasks/"), "/"),
+			strings.Trim(strings.TrimPrefix(requestURL, "/coverage/"), "/"),
+		)
+
+	case requestURL == "/hooks/stash":
+		if request.Method != "POST" {
+			return http.StatusMethodNotAllowed, nil
+		}
+
+		if !server.isHook(request) {
+			return http.StatusForbidden, nil
+		}
+
+		logger.Infof("handled request: stash webhook")
+		return server.handleStashHook(logger, request)
+
+	case strings.HasPrefix(requestURL, "/scheduler/"):
+		status = server.authorize(request, scopeAdmin)
+		if status != http.StatusOK {
+			return status, nil
+		}
+
+		logger.Infof("handled request: scheduler")
+		return server.handleScheduler(
+			logger, request,
+			strings.Trim(strings.TrimPrefix(requestURL, "/scheduler/"), "/"),
+		)
+
+	case strings.HasPrefix(requestURL, "/agents/"):
+		if !server.isAgent(request) {
+			status = server.authorize(request, scopeAdmin)
+			if status != http.StatusOK {
+				return status, nil
+			}
+		}
+
+		logger.Infof("handled request: agents")
+		return server.handleAgents(
+			logger, request,
+			strings.Trim(strings.TrimPrefix(requestURL, "/agents/"), "/"),
 		)
 
 	default:
@@ -83,21 +191,39 @@ func (server *WebServer) handleNewTask(
 	logger *lorg.Log,
 	request *http.Request,
 ) (status int, response interface{}) {
+	if server.isIntakeStopped() {
+		return http.StatusServiceUnavailable, errors.New(
+			"uroboros is shutting down, new tasks are not accepted",
+		)
+	}
+
 	err := request.ParseForm()
 	if err != nil {
 		logger.Error(err)
 		return http.StatusNotFound, nil
 	}
 
-	task, err := NewTaskStashPullRequest(
-		request.PostForm.Get("url"),
-	)
+	task, err := NewTaskFromURL(request.PostForm.Get("url"))
 	if err != nil {
 		logger.Error(err)
 		return http.StatusBadRequest, err
 	}
 
-	taskID := server.resources.queue.Push(task)
+	queue := server.getResources().queue
+
+	priority := queue.GetDefaultPriority(task, triggerManual)
+	if value := request.PostForm.Get("priority"); value != "" {
+		priority, err = ParseTaskPriority(value)
+		if err != nil {
+			logger.Error(err)
+			return http.StatusBadRequest, err
+		}
+	}
+
+	task.SetPriority(priority)
+	task.SetLabels(parseLabels(request.PostForm.Get("labels")))
+
+	taskID := queue.Push(task)
 
 	return http.StatusOK, ResponseTaskQueued{ID: taskID}
 }
@@ -106,34 +232,145 @@ func (server *WebServer) handleTask(
 	logger *lorg.Log,
 	query string,
 ) (status int, response interface{}) {
-	var task Task
-	if !strings.Contains(query, "/") {
-		taskID, err := strconv.Atoi(query)
-		if err != nil {
-			return http.StatusBadRequest, err
-		}
-
-		logger.Debugf("get task by unique id = %d", taskID)
-		task = server.resources.queue.GetTaskByUniqueID(taskID)
-	} else {
-		logger.Debugf("get task by identifier = %s", query)
-		task = server.resources.queue.GetTaskByIdentifier(query)
+	task, err := server.getTask(logger, query)
+	if err != nil {
+		return http.StatusBadRequest, err
 	}
 
 	if task == nil {
 		return http.StatusNotFound, nil
 	}
 
-	return http.StatusOK, ResponseTask{
+	result := ResponseTask{
 		UniqueID:   task.GetUniqueID(),
 		Identifier: task.GetIdentifier(),
 		State:      task.GetState().String(),
+		Priority:   task.GetPriority().String(),
+		Labels:     task.GetLabels(),
 		Title:      task.GetTitle(),
 		Logs: strings.Split(
 			strings.TrimSuffix(task.GetBuffer().String(), "\n"),
 			"\n",
 		),
+		LintFindings: task.GetLintFindings(),
+		TestReport:   task.GetTestReport(),
+		Coverage:     task.GetCoverage(),
+		Usage:        task.GetResourceUsage(),
+		Environment:  task.GetEnvironment(),
 	}
+
+	result.SetEstimate(server.getEstimates()[task.GetUniqueID()])
+
+	return http.StatusOK, result
+}
+
+func (server *WebServer) handleExportTask(
+	logger *lorg.Log,
+	query string,
+	format string,
+) (status int, response interface{}) {
+	task, err := server.getTask(logger, query)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if task == nil {
+		return http.StatusNotFound, nil
+	}
+
+	state := task.GetState()
+	if !state.IsFinished() {
+		return http.StatusConflict, fmt.Errorf(
+			"task is %s, only finished tasks can be exported", state,
+		)
+	}
+
+	export := taskExportFormats[format]
+
+	body, err := export.convert(task)
+	if err != nil {
+		logger.Error(hierr.Errorf(err, "can't export task as %s", format))
+		return http.StatusInternalServerError, nil
+	}
+
+	return http.StatusOK, ResponseRaw{
+		ContentType: export.contentType,
+		Body:        body,
+	}
+}
+
+func (server *WebServer) handleUpdateTask(
+	logger *lorg.Log,
+	request *http.Request,
+	query string,
+) (status int, response interface{}) {
+	err := request.ParseForm()
+	if err != nil {
+		logger.Error(err)
+		return http.StatusBadRequest, err
+	}
+
+	var (
+		priority TaskPriority
+		approve  = request.PostForm.Get("approve") == "true"
+		cancel   = request.PostForm.Get("cancel") == "true"
+	)
+
+	// request is validated and all scopes are checked before anything is
+	// changed, submit scope is checked by router.
+	if value := request.PostForm.Get("priority"); value != "" {
+		priority, err = ParseTaskPriority(value)
+		if err != nil {
+			logger.Error(err)
+			return http.StatusBadRequest, err
+		}
+	}
+
+	if approve {
+		status = server.authorize(request, scopeAdmin)
+		if status != http.StatusOK {
+			return status, nil
+		}
+	}
+
+	task, err := server.getTask(logger, query)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if task == nil {
+		return http.StatusNotFound, nil
+	}
+
+	if priority != 0 {
+		err = server.getResources().queue.SetPriority(task, priority)
+		if err != nil {
+			logger.Error(err)
+			return http.StatusConflict, err
+		}
+	}
+
+	if approve {
+		err = server.getResources().queue.Approve(task)
+		if err != nil {
+			logger.Error(err)
+			return http.StatusConflict, err
+		}
+
+		logger.Infof("task#%d approved through API", task.GetUniqueID())
+	}
+
+	if cancel {
+		err = server.getResources().queue.Cancel(task)
+		if err != nil {
+			logger.Error(err)
+			return http.StatusConflict, err
+		}
+
+		logger.Infof("task#%d cancelled through API", task.GetUniqueID())
+	}
+
+	return server.handleTask(logger, query)
 }
 
 func (server *WebServer) handleListTasks(
@@ -143,19 +380,56 @@ func (server *WebServer) handleListTasks(
 		Tasks: make([]ResponseTask, 0),
 	}
 
-	for i := len(server.resources.queue.tasks) - 1; i >= 0; i-- {
-		task := server.resources.queue.tasks[i]
+	var (
+		tasks     = server.getResources().queue.GetTasks()
+		estimates = server.getEstimates()
+	)
+
+	for i := len(tasks) - 1; i >= 0; i-- {
+		task := tasks[i]
 
-		tasksList.Tasks = append(
-			tasksList.Tasks,
-			ResponseTask{
-				UniqueID:   task.GetUniqueID(),
-				Identifier: task.GetIdentifier(),
-				State:      task.GetState().String(),
-				Title:      task.GetTitle(),
-			},
-		)
+		result := ResponseTask{
+			UniqueID:   task.GetUniqueID(),
+			Identifier: task.GetIdentifier(),
+			State:      task.GetState().String(),
+			Priority:   task.GetPriority().String(),
+			Labels:     task.GetLabels(),
+			Title:      task.GetTitle(),
+		}
+
+		result.SetEstimate(estimates[task.GetUniqueID()])
+
+		tasksList.Tasks = append(tasksList.Tasks, result)
 	}
 
 	return http.StatusOK, tasksList
 }
+
+func (server *WebServer) handleCoverage(
+	logger *lorg.Log,
+	query string,
+) (status int, response interface{}) {
+	slug, branch, err := parseCoverageQuery(query)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	records := server.getResources().coverage.GetRecords(slug, branch)
+
+	result := ResponseCoverageHistory{
+		Repository: slug,
+		Branch:     branch,
+		Builds:     []ResponseCoverage{},
+	}
+
+	for _, record := range records {
+		result.Builds = append(result.Builds, ResponseCoverage{
+			TaskID:     record.TaskID,
+			Commit:     record.Report.Commit,
+			Coverage:   record.Report.Coverage,
+			FinishedAt: record.FinishedAt,
+		})
+	}
+
+	return http.StatusOK, result
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kovetskiy/lorg"
+)
+
+func (server *WebServer) isAgent(request *http.Request) bool {
+	token := server.getResources().config.Agents.Token
+	if token == "" {
+		return false
+	}
+
+	given := strings.TrimPrefix(
+		request.Header.Get("Authorization"), "Bearer ",
+	)
+
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+func (server *WebServer) handleAgents(
+	logger *lorg.Log,
+	request *http.Request,
+	query string,
+) (status int, response interface{}) {
+	if query == "" {
+		switch request.Method {
+		case "GET":
+			return server.handleListAgents(logger)
+
+		case "POST":
+			return server.handleRegisterAgent(logger, request)
+
+		default:
+			return http.StatusMethodNotAllowed, nil
+		}
+	}
+
+	if request.Method != "POST" {
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	err := request.ParseForm()
+	if err != nil {
+		logger.Error(err)
+		return http.StatusBadRequest, err
+	}
+
+	var (
+		parts   = strings.Split(query, "/")
+		agentID = parts[0]
+	)
+
+	switch {
+	case len(parts) == 2 && parts[1] == "heartbeat":
+		if !server.getResources().agents.Heartbeat(agentID) {
+			return http.StatusNotFound, nil
+		}
+
+		return http.StatusOK, nil
+
+	case len(parts) == 2 && parts[1] == "lease":
+		return server.handleLeaseTask(logger, agentID)
+
+	case len(parts) == 4 && parts[1] == "tasks":
+		taskID, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+
+		switch parts[3] {
+		case "logs":
+			return server.handleAgentLogs(logger, request, agentID, taskID)
+
+		case "finish":
+			return server.handleAgentFinish(logger, request, agentID, taskID)
+		}
+	}
+
+	return http.StatusNotFound, nil
+}
+
+func (server *WebServer) handleListAgents(
+	logger *lorg.Log,
+) (status int, response interface{}) {
+	list := ResponseAgentList{
+		Agents: make([]ResponseAgent, 0),
+	}
+
+	for _, agent := range server.getResources().agents.GetAgents() {
+		tasks := []int64{}
+		for id := range agent.Tasks {
+			tasks = append(tasks, id)
+		}
+
+		sort.Slice(tasks, func(i, j int) bool {
+			return tasks[i] < tasks[j]
+		})
+
+		list.Agents = append(list.Agents, ResponseAgent{
+			ID:       agent.ID,
+			Name:     agent.Name,
+			Labels:   agent.Labels,
+			Threads:  agent.Threads,
+			LastSeen: agent.LastSeen,
+			Tasks:    tasks,
+		})
+	}
+
+	sort.Slice(list.Agents, func(i, j int) bool {
+		return list.Agents[i].ID < list.Agents[j].ID
+	})
+
+	return http.StatusOK, list
+}
+
+func (server *WebServer) handleRegisterAgent(
+	logger *lorg.Log,
+	request *http.Request,
+) (status int, response interface{}) {
+	if !server.isAgent(request) {
+		return http.StatusForbidden, nil
+	}
+
+	err := request.ParseForm()
+	if err != nil {
+		logger.Error(err)
+		return http.StatusBadRequest, err
+	}
+
+	name := request.PostForm.Get("name")
+	if name == "" {
+		return http.StatusBadRequest, errors.New("agent name is not specified")
+	}
+
+	threads := 1
+	if value := request.PostForm.Get("threads"); value != "" {
+		threads, err = strconv.Atoi(value)
+		if err != nil || threads < 1 {
+			return http.StatusBadRequest, errors.New(
+				"agent threads should be a positive number",
+			)
+		}
+	}
+
+	agent := server.getResources().agents.Register(
+		name, parseLabels(request.PostForm.Get("labels")), threads,
+	)
+
+	return http.StatusOK, ResponseAgent{
+		ID:       agent.ID,
+		Name:     agent.Name,
+		Labels:   agent.Labels,
+		Threads:  agent.Threads,
+		LastSeen: agent.LastSeen,
+		Tasks:    []int64{},
+
+		LeaseTimeout: server.getResources().agents.GetTimeout().String(),
+	}
+}
+
+func (server *WebServer) handleLeaseTask(
+	logger *lorg.Log,
+	agentID string,
+) (status int, response interface{}) {
+	if server.scheduler.GetStatus().State != SchedulerStateRunning {
+		if !server.getResources().agents.Heartbeat(agentID) {
+			return http.StatusNotFound, nil
+		}
+
+		return http.StatusNoContent, nil
+	}
+
+	task, err := server.getResources().agents.Lease(agentID)
+	if err != nil {
+		logger.Error(err)
+		return http.StatusNotFound, err
+	}
+
+	if task == nil {
+		return http.StatusNoContent, nil
+	}
+
+	kind, url := describeTask(task)
+
+	return http.StatusOK, ResponseLease{
+		ID:       task.GetUniqueID(),
+		Kind:     kind,
+		URL:      url,
+		Priority: task.GetPriority().String(),
+		Labels:   task.GetLabels(),
+		Approved: task.IsApproved(),
+		Commit:   task.GetCommit(),
+
+		LeaseTimeout: server.getResources().agents.GetTimeout().String(),
+	}
+}
+
+func (server *WebServer) handleAgentLogs(
+	logger *lorg.Log,
+	request *http.Request,
+	agentID string,
+	taskID int64,
+) (status int, response interface{}) {
+	task, err := server.getResources().agents.GetTask(agentID, taskID)
+	if err != nil {
+		logger.Error(err)
+		return http.StatusNotFound, err
+	}
+
+	task.GetBuffer().WriteString(request.PostForm.Get("logs"))
+	task.GetErrorBuffer().WriteString(request.PostForm.Get("errors"))
+
+	// agent cancels the task when it's cancelled on the server.
+	if task.GetContext().Err() != nil {
+		return http.StatusGone, nil
+	}
+
+	return http.StatusOK, nil
+}
+
+func (server *WebServer) handleAgentFinish(
+	logger *lorg.Log,
+	request *http.Request,
+	agentID string,
+	taskID int64,
+) (status int, response interface{}) {
+	var state TaskState
+	switch request.PostForm.Get("state") {
+	case TaskStateSuccess.String():
+		state = TaskStateSuccess
+
+	case TaskStateError.String():
+		state = TaskStateError
+
+	case TaskStateCancelled.String():
+		state = TaskStateCancelled
+
+	case TaskStateTimedOut.String():
+		state = TaskStateTimedOut
+
+	case TaskStateAwaitingApproval.String():
+		state = TaskStateAwaitingApproval
+
+	default:
+		return http.StatusBadRequest, errors.New(
+			"state should be success, error, cancelled, timed-out " +
+				"or awaiting-approval",
+		)
+	}
+
+	task, err := server.getResources().agents.GetTask(agentID, taskID)
+	if err != nil {
+		logger.Error(err)
+		return http.StatusNotFound, err
+	}
+
+	if value := request.PostForm.Get("lint_findings"); value != "" {
+		var findings []LintFinding
+		err = json.Unmarshal([]byte(value), &findings)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+
+		task.SetLintFindings(findings)
+	}
+
+	if value := request.PostForm.Get("test_report"); value != "" {
+		var report *TestReport
+		err = json.Unmarshal([]byte(value), &report)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+
+		task.SetTestReport(report)
+	}
+
+	if value := request.PostForm.Get("coverage"); value != "" {
+		var report *CoverageReport
+		err = json.Unmarshal([]byte(value), &report)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+
+		task.SetCoverage(report)
+	}
+
+	if value := request.PostForm.Get("usage"); value != "" {
+		var usage *ResourceUsage
+		err = json.Unmarshal([]byte(value), &usage)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+
+		task.SetResourceUsage(usage)
+	}
+
+	if value := request.PostForm.Get("environment"); value != "" {
+		var environment []string
+		err = json.Unmarshal([]byte(value), &environment)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+
+		task.SetEnvironment(environment)
+	}
+
+	if value := request.PostForm.Get("commit"); value != "" {
+		task.SetCommit(value)
+	}
+
+	err = server.getResources().agents.Finish(agentID, taskID, state)
+	if err != nil {
+		logger.Error(err)
+		return http.StatusNotFound, err
+	}
+
+	return http.StatusOK, nil
+}
+
+func parseLabels(value string) []string {
+	labels := []string{}
+	for _, label := range strings.Split(value, ",") {
+		label = strings.TrimSpace(label)
+		if label != "" {
+			labels = append(labels, label)
+		}
+	}
+
+	return labels
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/kovetskiy/lorg"
+)
+
+// stashEvent is a payload of Bitbucket Server repo:refs_changed and
+// pr:comment:added webhooks or Stash post-receive webhook, only fields which
+// describe pushed branches and comments are decoded.
+type stashEvent struct {
+	Repository struct {
+		Slug    string `json:"slug"`
+		Project struct {
+			Key string `json:"key"`
+		} `json:"project"`
+	} `json:"repository"`
+
+	Changes []struct {
+		Ref struct {
+			ID string `json:"id"`
+		} `json:"ref"`
+		ToHash string `json:"toHash"`
+		Type   string `json:"type"`
+	} `json:"changes"`
+
+	RefChanges []struct {
+		RefID  string `json:"refId"`
+		ToHash string `json:"toHash"`
+		Type   string `json:"type"`
+	} `json:"refChanges"`
+
+	Actor struct {
+		Name string `json:"name"`
+	} `json:"actor"`
+
+	PullRequest struct {
+		ID    int `json:"id"`
+		ToRef struct {
+			Repository struct {
+				Slug    string `json:"slug"`
+				Project struct {
+					Key string `json:"key"`
+				} `json:"project"`
+			} `json:"repository"`
+		} `json:"toRef"`
+	} `json:"pullRequest"`
+
+	Comment struct {
+		Text string `json:"text"`
+	} `json:"comment"`
+}
+
+// isHook returns true if request has token specified in
+// branches.webhook_token, token is passed as token query parameter because
+// Stash webhooks can't set headers.
+func (server *WebServer) isHook(request *http.Request) bool {
+	token := server.getResources().config.Branches.WebhookToken
+	if token == "" {
+		return false
+	}
+
+	given := request.URL.Query().Get("token")
+
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+func (server *WebServer) handleStashHook(
+	logger *lorg.Log,
+	request *http.Request,
+) (status int, response interface{}) {
+	var event stashEvent
+	err := json.NewDecoder(request.Body).Decode(&event)
+	if err != nil {
+		logger.Error(err)
+		return http.StatusBadRequest, err
+	}
+
+	if event.Comment.Text != "" {
+		return server.handleStashComment(logger, event)
+	}
+
+	var (
+		project    = event.Repository.Project.Key
+		repository = event.Repository.Slug
+		result     = ResponseHook{Tasks: []int64{}}
+	)
+
+	push := func(ref, commit, kind string) {
+		if kind == "DELETE" {
+			return
+		}
+
+		logger.Infof("%s/%s: %s pushed to %s", project, repository, commit, ref)
+
+		result.Tasks = append(
+			result.Tasks,
+			server.getResources().branches.Push(
+				project, repository, ref, commit,
+			)...,
+		)
+	}
+
+	for _, change := range event.Changes {
+		push(change.Ref.ID, change.ToHash, change.Type)
+	}
+
+	for _, change := range event.RefChanges {
+		push(change.RefID, change.ToHash, change.Type)
+	}
+
+	return http.StatusOK, result
+}
+
+// handleStashComment approves builds of the pull request which are awaiting
+// approval if the comment is an approve comment of maintainer.
+func (server *WebServer) handleStashComment(
+	logger *lorg.Log,
+	event stashEvent,
+) (status int, response interface{}) {
+	var (
+		policy     = server.getResources().config.Policy
+		project    = event.PullRequest.ToRef.Repository.Project.Key
+		repository = event.PullRequest.ToRef.Repository.Slug
+		identifier = strconv.Itoa(event.PullRequest.ID)
+		result     = ResponseHook{Tasks: []int64{}}
+	)
+
+	if strings.TrimSpace(event.Comment.Text) != policy.getApproveComment() {
+		return http.StatusOK, result
+	}
+
+	if !policy.isMaintainer(event.Actor.Name) {
+		logger.Warningf(
+			"%s/%s #%s: %s is not a maintainer, approve comment is ignored",
+			project, repository, identifier, event.Actor.Name,
+		)
+
+		return http.StatusOK, result
+	}
+
+	queue := server.getResources().queue
+	for _, task := range queue.GetAwaitingTasks() {
+		pullRequest, ok := task.(*TaskStashPullRequest)
+		if !ok ||
+			// personal repositories have project keys like ~john.
+			!strings.EqualFold(
+				pullRequest.Project, strings.TrimPrefix(project, "~"),
+			) ||
+			pullRequest.Repository != repository ||
+			pullRequest.Identifier != identifier {
+			continue
+		}
+
+		err := queue.Approve(task)
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+
+		logger.Infof(
+			"task#%d approved by %s", task.GetUniqueID(), event.Actor.Name,
+		)
+
+		result.Tasks = append(result.Tasks, task.GetUniqueID())
+	}
+
+	return http.StatusOK, result
+}
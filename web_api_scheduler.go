@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/kovetskiy/lorg"
+)
+
+func (server *WebServer) handleScheduler(
+	logger *lorg.Log,
+	request *http.Request,
+	action string,
+) (status int, response interface{}) {
+	if action == "" {
+		if request.Method != "GET" {
+			return http.StatusMethodNotAllowed, nil
+		}
+
+		return http.StatusOK, server.getSchedulerStatus()
+	}
+
+	if request.Method != "POST" {
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	switch action {
+	case "pause":
+		server.scheduler.Pause()
+
+	case "resume":
+		server.scheduler.Resume()
+
+	case "drain":
+		err := request.ParseForm()
+		if err != nil {
+			logger.Error(err)
+			return http.StatusBadRequest, err
+		}
+
+		server.scheduler.Drain()
+
+		if request.PostForm.Get("wait") == "true" &&
+			!server.scheduler.WaitDrained(request.Context()) {
+			return http.StatusConflict, errors.New(
+				"scheduler is not drained, it was resumed or paused",
+			)
+		}
+
+	case "threads":
+		err := request.ParseForm()
+		if err != nil {
+			logger.Error(err)
+			return http.StatusBadRequest, err
+		}
+
+		threads, err := strconv.Atoi(request.PostForm.Get("threads"))
+		if err != nil || threads < 1 {
+			return http.StatusBadRequest, errors.New(
+				"threads should be a positive number",
+			)
+		}
+
+		server.scheduler.SetThreads(threads)
+
+	default:
+		return http.StatusNotFound, nil
+	}
+
+	return http.StatusOK, server.getSchedulerStatus()
+}
+
+func (server *WebServer) getSchedulerStatus() ResponseScheduler {
+	status := server.scheduler.GetStatus()
+
+	return ResponseScheduler{
+		State:   status.State.String(),
+		Drained: status.Drained,
+		Threads: status.Threads,
+		Workers: status.Workers,
+		Busy:    status.Busy,
+		Queued:  server.getResources().queue.GetPendingCount(),
+	}
+}
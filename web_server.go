@@ -1,57 +1,85 @@
 package main
 
 import (
+	"context"
 	"net"
 	"net/http"
+	"sync"
 
 	"github.com/kovetskiy/lorg"
 	"github.com/reconquest/hierr-go"
 )
 
 const (
-	pathStatic                     = "/static/"
-	pathAPI                        = "/api/v1/"
-	pathBadge                      = "/badge/"
-	pathStatus                     = "/status/"
-	pathStaticBadges               = "/static/badges/"
-	pathStaticBadgeBuildPassing    = "/static/badges/build-passing.svg"
-	pathStaticBadgeBuildFailure    = "/static/badges/build-failure.svg"
-	pathStaticBadgeBuildProcessing = "/static/badges/build-processing.svg"
+	pathAPI           = "/api/v1/"
+	pathBadge         = "/badge/"
+	pathBadgeCoverage = "/badges/coverage/"
+	pathBadgeState    = "/badges/state/"
+	pathStatus        = "/status/"
+
+	// pathLegacyBadgeState is a path of state badges which were linked in
+	// pull request comments before state badges got their own prefix, it
+	// overlaps with pathBadge, see getLegacyStateBadge.
+	pathLegacyBadgeState = "/badge/state/"
+
+	// pathStaticBadges is a path of static badges which were linked in pull
+	// request comments before badges were rendered, see staticBadges.
+	pathStaticBadges = "/static/badges/"
 )
 
+// staticBadges maps names of static badges to task states, requests to
+// static badges are redirected to state badges.
+var staticBadges = map[string]TaskState{
+	"build-passing.svg":    TaskStateSuccess,
+	"build-failure.svg":    TaskStateError,
+	"build-processing.svg": TaskStateProcessing,
+}
+
 type WebServer struct {
 	mux       *http.ServeMux
+	http      *http.Server
 	address   string
+	listener  net.Listener
 	logger    *lorg.Log
 	resources *resources
+	scheduler *Scheduler
 	requests  int64
+	stopped   bool
+	errors    chan error
+	mutex     *sync.Mutex
 }
 
 func NewWebServer(
 	logger *lorg.Log,
 	resources *resources,
+	scheduler *Scheduler,
 ) *WebServer {
 	server := &WebServer{
 		mux:       http.NewServeMux(),
 		logger:    logger,
 		resources: resources,
+		scheduler: scheduler,
+		errors:    make(chan error, 1),
+		mutex:     &sync.Mutex{},
 	}
 
+	server.http = &http.Server{Handler: server.mux}
+
 	server.mux.HandleFunc(
 		pathAPI,
 		server.HandleAPI,
 	)
 
-	server.mux.HandleFunc(
-		pathStatic,
-		http.FileServer(http.Dir(".")).ServeHTTP,
-	)
-
 	server.mux.HandleFunc("/", server.HandleWeb)
 
 	return server
 }
 
+// Serve starts serving http connections at given address in background, if
+// server already listens another address, previous listener will be closed
+// after new one is ready, connections which are already accepted will be
+// served until completion. Errors occurred during serving are reported using
+// Errors channel.
 func (server *WebServer) Serve(address string) error {
 	addr, err := net.ResolveTCPAddr("tcp", address)
 	if err != nil {
@@ -68,7 +96,82 @@ func (server *WebServer) Serve(address string) error {
 		)
 	}
 
+	server.mutex.Lock()
+	previous := server.listener
+	server.listener = listener
+	server.address = address
+	server.mutex.Unlock()
+
+	if previous != nil {
+		server.logger.Infof("closing listener at %s", previous.Addr())
+
+		err = previous.Close()
+		if err != nil {
+			server.logger.Error(err)
+		}
+	}
+
 	server.logger.Infof("listening at %s", address)
 
-	return http.Serve(listener, server.mux)
+	go func() {
+		err := server.http.Serve(listener)
+		if err == http.ErrServerClosed {
+			return
+		}
+
+		server.mutex.Lock()
+		replaced := server.listener != listener
+		server.mutex.Unlock()
+
+		if !replaced {
+			server.errors <- err
+		}
+	}()
+
+	return nil
+}
+
+func (server *WebServer) Errors() <-chan error {
+	return server.errors
+}
+
+func (server *WebServer) GetAddress() string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return server.address
+}
+
+// StopIntake makes server reject new tasks, all other requests are still
+// served.
+func (server *WebServer) StopIntake() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.stopped = true
+}
+
+func (server *WebServer) isIntakeStopped() bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return server.stopped
+}
+
+func (server *WebServer) Shutdown(ctx context.Context) error {
+	return server.http.Shutdown(ctx)
+}
+
+func (server *WebServer) SetResources(resources *resources) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.resources = resources
+}
+
+func (server *WebServer) getResources() *resources {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return server.resources
 }
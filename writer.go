@@ -21,6 +21,22 @@ type unprefixed struct {
 	writer io.Writer
 }
 
+// masked replaces values of secrets, it should be the innermost writer, so
+// secrets are masked after styles are removed and can't be split by them.
+type masked struct {
+	writer io.Writer
+	masker *secretMasker
+}
+
+func (writer masked) Write(data []byte) (int, error) {
+	_, err := writer.writer.Write([]byte(writer.masker.Mask(string(data))))
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
 func (writer unprefixed) Write(data []byte) (int, error) {
 	return writer.writer.Write(
 		reLogPrefix.ReplaceAll(